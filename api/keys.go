@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// API key scopes
+const (
+	scopeRead  = "read"
+	scopeVote  = "vote"
+	scopeWrite = "write"
+	scopeAdmin = "admin"
+)
+
+// keyCacheTTL is how long a key looked up from the database is trusted.
+// A key revoked through another api server stays usable here for at most
+// this long.
+const keyCacheTTL = 1 * time.Minute
+
+// apiKey is an API key as stored in the api_keys collection. Only the
+// SHA-256 hash of the key itself is stored.
+type apiKey struct {
+	ID        primitive.ObjectID `bson:"_id" json:"id"`
+	Name      string             `bson:"name" json:"name"`
+	Hash      string             `bson:"hash" json:"-"`
+	Prefix    string             `bson:"prefix,omitempty" json:"prefix,omitempty"`
+	Scopes    []string           `bson:"scopes" json:"scopes"`
+	CreatedAt time.Time          `bson:"created_at" json:"created_at"`
+	ExpiresAt *time.Time         `bson:"expires_at,omitempty" json:"expires_at,omitempty"`
+	Revoked   bool               `bson:"revoked" json:"revoked"`
+	RateLimit *rateLimit         `bson:"rate_limit,omitempty" json:"rate_limit,omitempty"`
+}
+
+// HasScope reports whether the key grants the scope. Admin keys have
+// every scope and write keys can also read and vote.
+func (k *apiKey) HasScope(scope string) bool {
+	if slices.Contains(k.Scopes, scopeAdmin) {
+		return true
+	}
+	if (scope == scopeRead || scope == scopeVote) && slices.Contains(k.Scopes, scopeWrite) {
+		return true
+	}
+	return slices.Contains(k.Scopes, scope)
+}
+
+func (k *apiKey) valid(now time.Time) bool {
+	return !k.Revoked && (k.ExpiresAt == nil || now.Before(*k.ExpiresAt))
+}
+
+const (
+	// minKeyLen is the shortest raw key accepted, such as a bootstrap key.
+	minKeyLen = 20
+	// keyPrefixLen is how much of a raw key is stored in the clear, to tell
+	// keys apart when listing them.
+	keyPrefixLen = 4
+)
+
+func hashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func generateKey() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "sp_" + base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+type cachedKey struct {
+	key       *apiKey
+	fetchedAt time.Time
+}
+
+// keyStore looks up API keys in the api_keys collection, caching the
+// keys it finds for keyCacheTTL.
+type keyStore struct {
+	c *mongo.Collection
+
+	mu    sync.Mutex
+	cache map[string]cachedKey // by hash
+}
+
+func newKeyStore(db *mongo.Client) *keyStore {
+	return &keyStore{
+		c:     db.Database("ballots").Collection("api_keys"),
+		cache: make(map[string]cachedKey),
+	}
+}
+
+var errInvalidKey = errors.New("invalid API key")
+
+// lookup returns the valid key matching the raw key.
+func (ks *keyStore) lookup(ctx context.Context, raw string) (*apiKey, error) {
+	if raw == "" {
+		return nil, errInvalidKey
+	}
+	hash := hashKey(raw)
+	now := time.Now()
+	ks.mu.Lock()
+	cached, ok := ks.cache[hash]
+	ks.mu.Unlock()
+	if !ok || now.Sub(cached.fetchedAt) > keyCacheTTL {
+		var k apiKey
+		err := ks.c.FindOne(ctx, bson.M{"hash": hash}).Decode(&k)
+		if err == mongo.ErrNoDocuments {
+			return nil, errInvalidKey
+		}
+		if err != nil {
+			return nil, err
+		}
+		cached = cachedKey{key: &k, fetchedAt: now}
+		ks.mu.Lock()
+		ks.cache[hash] = cached
+		ks.mu.Unlock()
+	}
+	if !cached.key.valid(now) {
+		return nil, errInvalidKey
+	}
+	return cached.key, nil
+}
+
+// evict drops the key with the given ID from the cache.
+func (ks *keyStore) evict(id primitive.ObjectID) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	for hash, cached := range ks.cache {
+		if cached.key.ID == id {
+			delete(ks.cache, hash)
+		}
+	}
+}
+
+// issue generates a raw key for k and stores k, returning the raw key,
+// which cannot be recovered later.
+func (ks *keyStore) issue(ctx context.Context, k *apiKey) (string, error) {
+	raw, err := generateKey()
+	if err != nil {
+		return "", err
+	}
+	return raw, ks.insert(ctx, raw, k)
+}
+
+func (ks *keyStore) insert(ctx context.Context, raw string, k *apiKey) error {
+	k.ID = primitive.NewObjectID()
+	k.Hash = hashKey(raw)
+	if len(raw) >= minKeyLen {
+		k.Prefix = raw[:keyPrefixLen]
+	}
+	k.CreatedAt = time.Now().UTC()
+	_, err := ks.c.InsertOne(ctx, k)
+	return err
+}
+
+// bootstrap makes sure raw is a valid admin key, so that an empty
+// api_keys collection can be administered.
+func (ks *keyStore) bootstrap(ctx context.Context, raw string) error {
+	if len(raw) < minKeyLen {
+		return fmt.Errorf("bootstrap key must be at least %d characters", minKeyLen)
+	}
+	err := ks.c.FindOne(ctx, bson.M{"hash": hashKey(raw)}).Err()
+	if err == nil {
+		return nil
+	}
+	if err != mongo.ErrNoDocuments {
+		return err
+	}
+	return ks.insert(ctx, raw, &apiKey{Name: "bootstrap", Scopes: []string{scopeAdmin}})
+}
+
+func (ks *keyStore) ensureIndexes(ctx context.Context) error {
+	_, err := ks.c.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "hash", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	return err
+}
+
+func validScopes(scopes []string) bool {
+	if len(scopes) == 0 {
+		return false
+	}
+	for _, scope := range scopes {
+		switch scope {
+		case scopeRead, scopeVote, scopeWrite, scopeAdmin:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// issuedKey is the response to issuing a key, the only time the raw key
+// is ever returned.
+type issuedKey struct {
+	*apiKey
+	Key string `json:"key"`
+}
+
+func (s *Server) handleIssueKey(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Name      string     `json:"name"`
+		Scopes    []string   `json:"scopes"`
+		ExpiresAt *time.Time `json:"expires_at"`
+		RateLimit *rateLimit `json:"rate_limit"`
+	}
+	if err := decodeBody(r, &body); err != nil {
+		respondErr(w, r, http.StatusBadRequest, "failed to read key from request", err)
+		return
+	}
+	if body.Name == "" {
+		respondErr(w, r, http.StatusBadRequest, "name is required")
+		return
+	}
+	if !validScopes(body.Scopes) {
+		respondErr(w, r, http.StatusBadRequest, fmt.Sprintf("scopes must be some of %q, %q, %q and %q", scopeRead, scopeVote, scopeWrite, scopeAdmin))
+		return
+	}
+	if body.RateLimit != nil && !body.RateLimit.valid() {
+		respondErr(w, r, http.StatusBadRequest, "rate_limit needs a positive rate and burst")
+		return
+	}
+	k := &apiKey{
+		Name:      body.Name,
+		Scopes:    body.Scopes,
+		ExpiresAt: body.ExpiresAt,
+		RateLimit: body.RateLimit,
+	}
+	raw, err := s.keys.issue(r.Context(), k)
+	if err != nil {
+		respondErr(w, r, http.StatusInternalServerError, "failed to issue key", err)
+		return
+	}
+	w.Header().Set("Location", "keys/"+k.ID.Hex())
+	respond(w, r, http.StatusCreated, &issuedKey{apiKey: k, Key: raw})
+}
+
+func (s *Server) handleListKeys(w http.ResponseWriter, r *http.Request) {
+	cursor, err := s.keys.c.Find(r.Context(), bson.M{}, options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		respondErr(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	defer cursor.Close(r.Context())
+	result := []*apiKey{}
+	if err := cursor.All(r.Context(), &result); err != nil {
+		respondErr(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	respond(w, r, http.StatusOK, &result)
+}
+
+// handleRevokeKey revokes a key. The key stops working on this server at
+// once, but other api servers that have it cached keep accepting it for up
+// to keyCacheTTL.
+func (s *Server) handleRevokeKey(w http.ResponseWriter, r *http.Request) {
+	objID, err := primitive.ObjectIDFromHex(r.PathValue("id"))
+	if err != nil {
+		respondErr(w, r, http.StatusBadRequest, errors.New("invalid key ID format"))
+		return
+	}
+	result, err := s.keys.c.UpdateOne(r.Context(), bson.M{"_id": objID}, bson.M{"$set": bson.M{"revoked": true}})
+	if err != nil {
+		respondErr(w, r, http.StatusInternalServerError, "failed to revoke key", err)
+		return
+	}
+	if result.MatchedCount == 0 {
+		respondErr(w, r, http.StatusNotFound, "key not found")
+		return
+	}
+	s.keys.evict(objID)
+	respond(w, r, http.StatusOK, nil)
+}
@@ -0,0 +1,13 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestBootstrapRejectsShortKeys(t *testing.T) {
+	ks := &keyStore{}
+	if err := ks.bootstrap(context.Background(), "abc123"); err == nil {
+		t.Error("bootstrap accepted a 6 character key")
+	}
+}
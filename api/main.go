@@ -5,7 +5,12 @@ import (
 	"flag"
 	"log"
 	"net/http"
+	"time"
 
+	"github.com/gorilla/websocket"
+	"github.com/liyu-wang/go-socialpoll/broker"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
@@ -14,7 +19,24 @@ func main() {
 	var (
 		addr = flag.String("addr", ":8080", "endpoint address")
 		mgo  = flag.String("mongo", "mongodb://localhost:27017", "MongoDB address")
+		boot = flag.String("bootstrap-key", "", "API key to create with admin scope if missing")
+
+		keyRate   = flag.Float64("rate", 10, "requests per second allowed per API key")
+		keyBurst  = flag.Int("burst", 20, "request burst allowed per API key")
+		ipRate    = flag.Float64("ip-rate", 20, "requests per second allowed per client IP")
+		ipBurst   = flag.Int("ip-burst", 40, "request burst allowed per client IP")
+		overrides = flag.String("rate-limits", "", "JSON file of per-key rate limit overrides")
 	)
+	brokerConfig := broker.Flags(flag.CommandLine)
+	flag.Parse()
+	if brokerConfig.Kind == broker.KindInproc {
+		// nothing in this process counts the votes
+		log.Fatal("Votes cannot be published in-process from the api")
+	}
+	limitOverrides, err := loadRateLimitOverrides(*overrides)
+	if err != nil {
+		log.Fatal("Failed to load rate limits:", err)
+	}
 	log.Println("Dialing mongo", *mgo)
 	db, err := mongo.Connect(context.Background(), options.Client().ApplyURI(*mgo))
 	if err != nil {
@@ -22,11 +44,46 @@ func main() {
 	}
 	defer db.Disconnect(context.Background())
 
+	votes, err := broker.NewPublisher(*brokerConfig)
+	if err != nil {
+		log.Fatal("Failed to connect to "+brokerConfig.Kind+":", err)
+	}
+	defer votes.Close()
+
 	s := &Server{
-		db: db,
+		db:    db,
+		keys:  newKeyStore(db),
+		votes: votes,
+		limits: &rateLimits{
+			key:       rateLimit{Rate: *keyRate, Burst: *keyBurst},
+			ip:        rateLimit{Rate: *ipRate, Burst: *ipBurst},
+			overrides: limitOverrides,
+			limiter:   newRateLimiter(),
+		},
+	}
+
+	setupCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	err = ensureIndexes(setupCtx, db)
+	if err == nil {
+		err = s.keys.ensureIndexes(setupCtx)
+	}
+	if err == nil && *boot != "" {
+		err = s.keys.bootstrap(setupCtx, *boot)
 	}
+	if err == nil {
+		// after bootstrapping, whose key may have created old polls
+		err = migrateOwners(setupCtx, db, s.keys)
+	}
+	cancel()
+	if err != nil {
+		log.Fatal("Failed to set up database:", err)
+	}
+
+	routes := withCORS(s.withIPRateLimit(s.withAPIKey(s.withKeyRateLimit(s.routes().ServeHTTP))))
 	mux := http.NewServeMux()
-	mux.HandleFunc("/polls/", withCORS(withAPIKey(s.handlePolls)))
+	mux.HandleFunc("/polls/", routes)
+	mux.HandleFunc("/keys/", routes)
+	mux.HandleFunc("/ws", routes)
 	log.Println("Starting server on", *addr)
 	http.ListenAndServe(*addr, mux)
 	log.Println("Stopping")
@@ -34,7 +91,87 @@ func main() {
 
 // Server is the API server
 type Server struct {
-	db *mongo.Client
+	db     *mongo.Client
+	keys   *keyStore
+	limits *rateLimits
+	votes  broker.Publisher
+}
+
+func (s *Server) routes() *Router {
+	rt := NewRouter()
+	rt.Handle(http.MethodGet, "polls", withScope(scopeRead, s.handleListPolls))
+	rt.Handle(http.MethodPost, "polls", withScope(scopeWrite, s.handleCreatePoll))
+	rt.Handle(http.MethodGet, "polls/{id}", withScope(scopeRead, s.handleGetPoll))
+	rt.Handle(http.MethodPut, "polls/{id}", withScope(scopeWrite, s.handleUpdatePoll))
+	rt.Handle(http.MethodPatch, "polls/{id}", withScope(scopeWrite, s.handleUpdatePoll))
+	rt.Handle(http.MethodDelete, "polls/{id}", withScope(scopeWrite, s.handleDeletePoll))
+	rt.Handle(http.MethodGet, "polls/{id}/results", withScope(scopeRead, s.handleGetResults))
+	rt.Handle(http.MethodGet, "polls/{id}/results/stream", withScope(scopeRead, s.handleStreamResults))
+	rt.Handle(http.MethodGet, "polls/{id}/options", withScope(scopeRead, s.handleGetOptions))
+	rt.Handle(http.MethodPost, "polls/{id}/options", withScope(scopeWrite, s.handleAddOption))
+	rt.Handle(http.MethodDelete, "polls/{id}/options/{option}", withScope(scopeWrite, s.handleRemoveOption))
+	rt.Handle(http.MethodGet, "polls/{id}/votes", withScope(scopeRead, s.handleListVotes))
+	rt.Handle(http.MethodPost, "polls/{id}/votes", withScope(scopeVote, s.handleCastVote))
+	rt.Handle(http.MethodGet, "ws", withScope(scopeRead, s.handleWS))
+	rt.Handle(http.MethodGet, "keys", withScope(scopeAdmin, s.handleListKeys))
+	rt.Handle(http.MethodPost, "keys", withScope(scopeAdmin, s.handleIssueKey))
+	rt.Handle(http.MethodDelete, "keys/{id}", withScope(scopeAdmin, s.handleRevokeKey))
+	return rt
+}
+
+// ensureIndexes creates the indexes backing the poll listing filters and
+// sort orders.
+func ensureIndexes(ctx context.Context, db *mongo.Client) error {
+	c := db.Database("ballots").Collection("polls")
+	_, err := c.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "_id", Value: 1}}},
+		{Keys: bson.D{{Key: "owner", Value: 1}, {Key: "_id", Value: 1}}},
+		{Keys: bson.D{{Key: "title", Value: 1}, {Key: "_id", Value: 1}}},
+	})
+	return err
+}
+
+// migrateOwners makes the API key that polls used to store in the clear
+// their owner, by looking up its record. The raw key is only removed from
+// polls whose owner is known, so polls whose key has no record yet keep
+// it until the key is added.
+func migrateOwners(ctx context.Context, db *mongo.Client, keys *keyStore) error {
+	c := db.Database("ballots").Collection("polls")
+	cursor, err := c.Find(ctx, bson.M{"apikey": bson.M{"$exists": true}}, options.Find().SetProjection(bson.M{"apikey": 1, "owner": 1}))
+	if err != nil {
+		return err
+	}
+	var polls []struct {
+		ID     primitive.ObjectID `bson:"_id"`
+		APIKey string             `bson:"apikey"`
+		Owner  string             `bson:"owner"`
+	}
+	if err := cursor.All(ctx, &polls); err != nil {
+		return err
+	}
+	for _, p := range polls {
+		owner := p.Owner
+		if owner == "" {
+			var k apiKey
+			err := keys.c.FindOne(ctx, bson.M{"hash": hashKey(p.APIKey)}).Decode(&k)
+			if err == mongo.ErrNoDocuments {
+				log.Printf("poll %s: no record of the API key that created it, leaving it without an owner", p.ID.Hex())
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			owner = k.ID.Hex()
+		}
+		_, err := c.UpdateOne(ctx, bson.M{"_id": p.ID}, bson.M{
+			"$set":   bson.M{"owner": owner},
+			"$unset": bson.M{"apikey": ""},
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 type contextKey struct {
@@ -43,32 +180,53 @@ type contextKey struct {
 
 var contextKeyAPIKey = &contextKey{"api-key"}
 
-func APIKey(ctx context.Context) (string, bool) {
-	key, ok := ctx.Value(contextKeyAPIKey).(string)
+func APIKey(ctx context.Context) (*apiKey, bool) {
+	key, ok := ctx.Value(contextKeyAPIKey).(*apiKey)
 	return key, ok
 }
 
-func withAPIKey(fn http.HandlerFunc) http.HandlerFunc {
+func (s *Server) withAPIKey(fn http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		apiKey := r.Header.Get("X-API-Key")
-		if !isValidAPIKey(apiKey) {
+		if r.Method == http.MethodOptions {
+			// CORS preflight requests never carry the API key
+			fn(w, r)
+			return
+		}
+		raw := r.Header.Get("X-API-Key")
+		if raw == "" && websocket.IsWebSocketUpgrade(r) {
+			// browsers cannot set headers on websocket requests
+			raw = r.URL.Query().Get("api_key")
+		}
+		apiKey, err := s.keys.lookup(r.Context(), raw)
+		if err == errInvalidKey {
 			respondErr(w, r, http.StatusUnauthorized, "invalid API key")
 			return
 		}
+		if err != nil {
+			respondErr(w, r, http.StatusInternalServerError, "failed to check API key", err)
+			return
+		}
 		ctx := context.WithValue(r.Context(), contextKeyAPIKey, apiKey)
 		fn(w, r.WithContext(ctx))
 	}
 }
 
-func isValidAPIKey(key string) bool {
-	// For demonstration purposes, we accept a single hardcoded API key.
-	return key == "abc123"
+// withScope only calls fn if the request's API key grants the scope.
+func withScope(scope string, fn http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key, ok := APIKey(r.Context())
+		if !ok || !key.HasScope(scope) {
+			respondErr(w, r, http.StatusForbidden, "API key lacks the "+scope+" scope")
+			return
+		}
+		fn(w, r)
+	}
 }
 
 func withCORS(fn http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Expose-Headers", "Location")
+		w.Header().Set("Access-Control-Expose-Headers", "Location, ETag, X-Total-Count, X-Next-Cursor, Retry-After, X-RateLimit-Limit, X-RateLimit-Remaining, X-RateLimit-Reset")
 		fn(w, r)
 	}
 }
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func (s *Server) handleGetOptions(w http.ResponseWriter, r *http.Request) {
+	objID, ok := pollID(w, r)
+	if !ok {
+		return
+	}
+	p, ok := s.findPoll(w, r, objID)
+	if !ok {
+		return
+	}
+	options := p.Options
+	if options == nil {
+		options = []string{}
+	}
+	respond(w, r, http.StatusOK, options)
+}
+
+func (s *Server) handleAddOption(w http.ResponseWriter, r *http.Request) {
+	c := s.db.Database("ballots").Collection("polls")
+	objID, ok := pollID(w, r)
+	if !ok {
+		return
+	}
+	p, ok := s.findPoll(w, r, objID)
+	if !ok || !canModify(w, r, p) {
+		return
+	}
+	var body struct {
+		Option string `json:"option"`
+	}
+	if err := decodeBody(r, &body); err != nil {
+		respondErr(w, r, http.StatusBadRequest, "failed to read option from request", err)
+		return
+	}
+	option := strings.TrimSpace(body.Option)
+	if err := validOption(option); err != nil {
+		respondErr(w, r, http.StatusBadRequest, err)
+		return
+	}
+	if slices.Contains(p.Options, option) {
+		respondErr(w, r, http.StatusConflict, fmt.Sprintf("option %q already exists", option))
+		return
+	}
+	sel := bson.M{"_id": objID, "options": bson.M{"$ne": option}}
+	up := bson.M{
+		"$push": bson.M{"options": option},
+		"$inc":  bson.M{"version": 1},
+	}
+	result, err := c.UpdateOne(r.Context(), sel, up)
+	if err != nil {
+		respondErr(w, r, http.StatusInternalServerError, "failed to add option", err)
+		return
+	}
+	if result.MatchedCount == 0 {
+		respondErr(w, r, http.StatusConflict, fmt.Sprintf("option %q already exists", option))
+		return
+	}
+	w.Header().Set("Location", "polls/"+objID.Hex()+"/options/"+url.PathEscape(option))
+	respond(w, r, http.StatusCreated, nil)
+}
+
+// handleRemoveOption removes an option from a poll. Like updating the poll,
+// an option that already has votes can only be removed with ?force=true.
+func (s *Server) handleRemoveOption(w http.ResponseWriter, r *http.Request) {
+	c := s.db.Database("ballots").Collection("polls")
+	objID, ok := pollID(w, r)
+	if !ok {
+		return
+	}
+	p, ok := s.findPoll(w, r, objID)
+	if !ok || !canModify(w, r, p) {
+		return
+	}
+	option := r.PathValue("option")
+	if !slices.Contains(p.Options, option) {
+		respondErr(w, r, http.StatusNotFound, "option not found")
+		return
+	}
+	if p.Results[option] > 0 && r.URL.Query().Get("force") != "true" {
+		respondErr(w, r, http.StatusConflict, fmt.Sprintf("option %q already has votes, use force=true to remove it", option))
+		return
+	}
+	up := bson.M{
+		"$pull":  bson.M{"options": option},
+		"$unset": bson.M{"results." + option: "", "match.aliases." + option: "", "match.patterns." + option: ""},
+		"$inc":   bson.M{"version": 1},
+	}
+	result, err := c.UpdateOne(r.Context(), versionFilter(objID, p.Version), up)
+	if err != nil {
+		respondErr(w, r, http.StatusInternalServerError, "failed to remove option", err)
+		return
+	}
+	if result.MatchedCount == 0 {
+		respondErr(w, r, http.StatusPreconditionFailed, "poll has been modified")
+		return
+	}
+	respond(w, r, http.StatusOK, nil)
+}
@@ -1,81 +1,308 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// poll statuses
+const (
+	statusDraft    = "draft"
+	statusOpen     = "open"
+	statusClosed   = "closed"
+	statusArchived = "archived"
 )
 
 type poll struct {
-	ID      primitive.ObjectID `bson:"_id" json:"id"`
-	Title   string             `bson:"title" json:"title"`
-	Options []string           `bson:"options" json:"options"`
-	Results map[string]int     `bson:"results,omitempty" json:"results,omitempty"`
-	// only for demonstrating how we extract the api key from the context
-	APIKey string `bson:"apikey" json:"apikey"`
+	ID       primitive.ObjectID `bson:"_id" json:"id"`
+	Title    string             `bson:"title" json:"title"`
+	Hashtag  string             `bson:"hashtag,omitempty" json:"hashtag,omitempty"`
+	Options  []string           `bson:"options" json:"options"`
+	Results  map[string]int     `bson:"results,omitempty" json:"results,omitempty"`
+	Status   string             `bson:"status" json:"status"`
+	OpensAt  *time.Time         `bson:"opens_at,omitempty" json:"opens_at,omitempty"`
+	ClosesAt *time.Time         `bson:"closes_at,omitempty" json:"closes_at,omitempty"`
+	Version  int                `bson:"version" json:"version"`
+	// Type is how votes are cast and counted, plurality when missing
+	Type string `bson:"type,omitempty" json:"type,omitempty"`
+	// VotePolicy limits how often each voter can vote, the counter's
+	// default policy applies when it is missing
+	VotePolicy *votePolicy `bson:"vote_policy,omitempty" json:"vote_policy,omitempty"`
+	// Match sets how chatvotes finds the options in messages
+	Match *matchRules `bson:"match,omitempty" json:"match,omitempty"`
+	// Owner is the ID of the API key that created the poll
+	Owner string `bson:"owner,omitempty" json:"owner,omitempty"`
 }
 
-func (s *Server) handlePolls(w http.ResponseWriter, r *http.Request) {
-	switch r.Method {
-	case http.MethodGet:
-		s.handleGetPolls(w, r)
-		return
-	case http.MethodPost:
-		s.handleCreatePoll(w, r)
-		return
-	case http.MethodDelete:
-		s.handleDeletePoll(w, r)
-		return
-	case http.MethodOptions:
-		// CORS preflight
-		w.Header().Set("Access-Control-Allow-Methods", "DELETE")
-		respond(w, r, http.StatusOK, nil)
-		return
+// validate checks the lifecycle fields of the poll, defaulting an empty
+// status to open.
+func (p *poll) validate() error {
+	switch p.Status {
+	case "":
+		p.Status = statusOpen
+	case statusDraft, statusOpen, statusClosed, statusArchived:
+	default:
+		return fmt.Errorf("invalid status %q", p.Status)
+	}
+	switch p.Type {
+	case "", typePlurality, typeApproval, typeRanked, typeWeighted:
+	default:
+		return fmt.Errorf("invalid type %q", p.Type)
+	}
+	for i, option := range p.Options {
+		if err := validOption(option); err != nil {
+			return err
+		}
+		if slices.Contains(p.Options[:i], option) {
+			return fmt.Errorf("duplicate option %q", option)
+		}
 	}
-	// not found
-	respondHTTPErr(w, r, http.StatusNotFound)
+	if p.OpensAt != nil && p.ClosesAt != nil && !p.ClosesAt.After(*p.OpensAt) {
+		return errors.New("closes_at must be after opens_at")
+	}
+	if p.Match != nil {
+		if err := p.Match.validate(p.Options); err != nil {
+			return err
+		}
+	}
+	if p.VotePolicy != nil {
+		return p.VotePolicy.validate()
+	}
+	return nil
 }
 
-func (s *Server) handleGetPolls(w http.ResponseWriter, r *http.Request) {
-	c := s.db.Database("ballots").Collection("polls")
-	p := NewPath(r.URL.Path)
-	if p.HasID() {
-		// get specific poll
-		objID, err := primitive.ObjectIDFromHex(p.ID)
-		if err != nil {
-			respondErr(w, r, http.StatusBadRequest, errors.New("invalid poll ID format"))
-			return
+// validOption checks that an option can be a key of the poll's results,
+// which the counter increments at "results.{option}".
+func validOption(option string) error {
+	switch {
+	case strings.TrimSpace(option) == "":
+		return errors.New("options must not be empty")
+	case strings.Contains(option, "."):
+		return fmt.Errorf("option %q must not contain \".\"", option)
+	case strings.HasPrefix(option, "$"):
+		return fmt.Errorf("option %q must not start with \"$\"", option)
+	}
+	return nil
+}
+
+// matchRules set how chatvotes finds the options of a poll in messages:
+// as whole words (word) or only as hashtags (hashtag), what to do when a
+// message mentions several options of a single choice poll (count all,
+// the first, or none), and aliases and regular expressions that also
+// match each option.
+type matchRules struct {
+	Mode     string              `bson:"mode,omitempty" json:"mode,omitempty"`
+	Multiple string              `bson:"multiple,omitempty" json:"multiple,omitempty"`
+	Aliases  map[string][]string `bson:"aliases,omitempty" json:"aliases,omitempty"`
+	Patterns map[string]string   `bson:"patterns,omitempty" json:"patterns,omitempty"`
+}
+
+func (mr *matchRules) validate(options []string) error {
+	switch mr.Mode {
+	case "", "word", "hashtag":
+	default:
+		return fmt.Errorf("invalid match mode %q", mr.Mode)
+	}
+	switch mr.Multiple {
+	case "", "all", "first", "none":
+	default:
+		return fmt.Errorf("invalid match multiple rule %q", mr.Multiple)
+	}
+	for option := range mr.Aliases {
+		if !slices.Contains(options, option) {
+			return fmt.Errorf("aliases for unknown option %q", option)
 		}
-		var singlePoll *poll
-		err = c.FindOne(r.Context(), bson.M{"_id": objID}).Decode(&singlePoll)
-		if err != nil {
-			if err == mongo.ErrNoDocuments {
-				respondErr(w, r, http.StatusNotFound, errors.New("poll not found"))
-			} else {
-				respondErr(w, r, http.StatusInternalServerError, err)
-			}
-			return
+	}
+	for option, pattern := range mr.Patterns {
+		if !slices.Contains(options, option) {
+			return fmt.Errorf("pattern for unknown option %q", option)
 		}
-		respond(w, r, http.StatusOK, &singlePoll)
-	} else {
-		// get all polls
-		var result []*poll
-		cursor, err := c.Find(r.Context(), bson.M{})
-		if err != nil {
-			respondErr(w, r, http.StatusInternalServerError, err)
-			return
+		if _, err := regexp.Compile(pattern); err != nil {
+			return fmt.Errorf("invalid pattern for option %q: %w", option, err)
 		}
-		defer cursor.Close(r.Context())
-		err = cursor.All(r.Context(), &result)
-		if err != nil {
+	}
+	return nil
+}
+
+// poll types, see the counter
+const (
+	typePlurality = "plurality" // one option per vote
+	typeApproval  = "approval"  // any number of options per vote
+	typeRanked    = "ranked"    // options in order of preference, instant-runoff
+	typeWeighted  = "weighted"  // one option per vote, counted by weight
+)
+
+// pollType returns the type of the poll, defaulting to plurality.
+func (p *poll) pollType() string {
+	if p.Type == "" {
+		return typePlurality
+	}
+	return p.Type
+}
+
+// voting policies, see the counter
+const (
+	policyUnlimited = "unlimited"
+	policySingle    = "single"
+	policyChange    = "change"
+	policyWindow    = "window"
+)
+
+// votePolicy limits how often a voter can vote in a poll: every vote
+// counts (unlimited), only the first (single), only the last (change), or
+// up to Limit votes per Window (window).
+type votePolicy struct {
+	Mode   string `bson:"mode" json:"mode"`
+	Limit  int    `bson:"limit,omitempty" json:"limit,omitempty"`
+	Window string `bson:"window,omitempty" json:"window,omitempty"`
+}
+
+func (vp *votePolicy) validate() error {
+	switch vp.Mode {
+	case policyUnlimited, policySingle, policyChange:
+		return nil
+	case policyWindow:
+		d, err := time.ParseDuration(vp.Window)
+		if err != nil || d <= 0 || vp.Limit < 1 {
+			return errors.New("window vote policy needs a positive limit and window such as \"1h\"")
+		}
+		return nil
+	}
+	return fmt.Errorf("invalid vote policy %q", vp.Mode)
+}
+
+// currentStatus is the status of the poll at the given time, taking its
+// voting window into account. Polls created before statuses existed are open.
+func (p *poll) currentStatus(now time.Time) string {
+	if p.Status != "" && p.Status != statusOpen {
+		return p.Status
+	}
+	if p.ClosesAt != nil && !now.Before(*p.ClosesAt) {
+		return statusClosed
+	}
+	if p.OpensAt != nil && now.Before(*p.OpensAt) {
+		return statusDraft
+	}
+	return statusOpen
+}
+
+// pollID parses the {id} path segment, responding with an error if it is
+// not a valid poll ID.
+func pollID(w http.ResponseWriter, r *http.Request) (primitive.ObjectID, bool) {
+	objID, err := primitive.ObjectIDFromHex(r.PathValue("id"))
+	if err != nil {
+		respondErr(w, r, http.StatusBadRequest, errors.New("invalid poll ID format"))
+		return objID, false
+	}
+	return objID, true
+}
+
+// findPoll loads the poll with the given ID, responding with an error if
+// it cannot be found.
+func (s *Server) findPoll(w http.ResponseWriter, r *http.Request, objID primitive.ObjectID) (*poll, bool) {
+	p, err := s.loadPoll(r.Context(), objID)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			respondErr(w, r, http.StatusNotFound, errors.New("poll not found"))
+		} else {
 			respondErr(w, r, http.StatusInternalServerError, err)
-			return
 		}
-		respond(w, r, http.StatusOK, &result)
+		return nil, false
+	}
+	return p, true
+}
+
+// loadPoll loads the poll with the given ID.
+func (s *Server) loadPoll(ctx context.Context, objID primitive.ObjectID) (*poll, error) {
+	c := s.db.Database("ballots").Collection("polls")
+	var p poll
+	if err := c.FindOne(ctx, bson.M{"_id": objID}).Decode(&p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// canModify reports whether the request's API key may modify the poll,
+// responding with an error if not. Only the key that created a poll, or an
+// admin key, may modify it.
+func canModify(w http.ResponseWriter, r *http.Request, p *poll) bool {
+	key, ok := APIKey(r.Context())
+	if ok && (key.HasScope(scopeAdmin) || (p.Owner != "" && p.Owner == key.ID.Hex())) {
+		return true
 	}
+	respondErr(w, r, http.StatusForbidden, "only the poll owner can modify it")
+	return false
+}
+
+// handleListPolls lists a page of polls, see pollsQuery for the query
+// parameters. The total number of matching polls is sent in the
+// X-Total-Count header and the cursor of the next page, if any, in the
+// X-Next-Cursor header.
+func (s *Server) handleListPolls(w http.ResponseWriter, r *http.Request) {
+	c := s.db.Database("ballots").Collection("polls")
+	key, _ := APIKey(r.Context())
+	now := time.Now()
+	pq, err := parsePollsQuery(r.URL.Query(), key, now)
+	if err != nil {
+		respondErr(w, r, http.StatusBadRequest, err)
+		return
+	}
+	total, err := c.CountDocuments(r.Context(), pq.filter)
+	if err != nil {
+		respondErr(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	// fetch one extra poll to know whether there is a next page
+	opts := options.Find().SetSort(pq.sort()).SetLimit(pq.limit + 1)
+	cursor, err := c.Find(r.Context(), pq.find(), opts)
+	if err != nil {
+		respondErr(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	defer cursor.Close(r.Context())
+	result := []*poll{}
+	err = cursor.All(r.Context(), &result)
+	if err != nil {
+		respondErr(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	if int64(len(result)) > pq.limit {
+		result = result[:pq.limit]
+		w.Header().Set("X-Next-Cursor", pq.next(result[len(result)-1]))
+	}
+	w.Header().Set("X-Total-Count", strconv.FormatInt(total, 10))
+	for _, p := range result {
+		p.Status = p.currentStatus(now)
+	}
+	respond(w, r, http.StatusOK, &result)
+}
+
+func (s *Server) handleGetPoll(w http.ResponseWriter, r *http.Request) {
+	objID, ok := pollID(w, r)
+	if !ok {
+		return
+	}
+	p, ok := s.findPoll(w, r, objID)
+	if !ok {
+		return
+	}
+	p.Status = p.currentStatus(time.Now())
+	w.Header().Set("ETag", etag(p.Version))
+	respond(w, r, http.StatusOK, p)
 }
 
 func (s *Server) handleCreatePoll(w http.ResponseWriter, r *http.Request) {
@@ -85,11 +312,17 @@ func (s *Server) handleCreatePoll(w http.ResponseWriter, r *http.Request) {
 		respondErr(w, r, http.StatusBadRequest, "failed to read poll from request", err)
 		return
 	}
+	if err := p.validate(); err != nil {
+		respondErr(w, r, http.StatusBadRequest, err)
+		return
+	}
 	apikey, ok := APIKey(r.Context())
 	if ok {
-		p.APIKey = apikey
+		p.Owner = apikey.ID.Hex()
 	}
 	p.ID = primitive.NewObjectID()
+	p.Results = nil
+	p.Version = 1
 	result, err := c.InsertOne(r.Context(), p)
 	if err != nil {
 		respondErr(w, r, http.StatusInternalServerError, "failed to create poll", err)
@@ -100,16 +333,170 @@ func (s *Server) handleCreatePoll(w http.ResponseWriter, r *http.Request) {
 	respond(w, r, http.StatusCreated, result)
 }
 
-func (s *Server) handleDeletePoll(w http.ResponseWriter, r *http.Request) {
+// handleUpdatePoll replaces (PUT) or merge-patches (PATCH) a poll.
+// Results are never written by an update, and an option that already has
+// votes can only be removed with ?force=true, which also drops its results.
+// Requests may send If-Match with the poll's ETag, or the poll's version in
+// the body, to guard against lost updates; the update itself only ever
+// applies to the version it read.
+func (s *Server) handleUpdatePoll(w http.ResponseWriter, r *http.Request) {
 	c := s.db.Database("ballots").Collection("polls")
-	p := NewPath(r.URL.Path)
-	if !p.HasID() {
-		respondErr(w, r, http.StatusBadRequest, "missing poll ID")
+	objID, ok := pollID(w, r)
+	if !ok {
+		return
+	}
+	current, ok := s.findPoll(w, r, objID)
+	if !ok || !canModify(w, r, current) {
 		return
 	}
-	objID, err := primitive.ObjectIDFromHex(p.ID)
+	if match := r.Header.Get("If-Match"); match != "" && match != "*" && match != etag(current.Version) {
+		respondErr(w, r, http.StatusPreconditionFailed, "poll has been modified")
+		return
+	}
+
+	var updated poll
+	var err error
+	if r.Method == http.MethodPatch {
+		err = decodePatch(r, *current, &updated)
+	} else {
+		err = decodeBody(r, &updated)
+	}
 	if err != nil {
-		respondErr(w, r, http.StatusBadRequest, errors.New("invalid poll ID format"))
+		respondErr(w, r, http.StatusBadRequest, "failed to read poll from request", err)
+		return
+	}
+	if updated.Version != 0 && updated.Version != current.Version {
+		respondErr(w, r, http.StatusPreconditionFailed, "poll has been modified")
+		return
+	}
+	if err := updated.validate(); err != nil {
+		respondErr(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	if updated.pollType() != current.pollType() && len(current.Results) > 0 {
+		respondErr(w, r, http.StatusConflict, "the type of a poll cannot change once it has votes")
+		return
+	}
+
+	force := r.URL.Query().Get("force") == "true"
+	unset := bson.M{}
+	for _, option := range removedOptions(current.Options, updated.Options) {
+		if current.Results[option] > 0 && !force {
+			respondErr(w, r, http.StatusConflict, fmt.Sprintf("option %q already has votes, use force=true to remove it", option))
+			return
+		}
+		unset["results."+option] = ""
+	}
+	set := bson.M{
+		"title":   updated.Title,
+		"hashtag": updated.Hashtag,
+		"options": updated.Options,
+		"status":  updated.Status,
+	}
+	if updated.Type != "" {
+		set["type"] = updated.Type
+	} else {
+		unset["type"] = ""
+	}
+	if updated.Match != nil {
+		set["match"] = updated.Match
+	} else {
+		unset["match"] = ""
+	}
+	if updated.VotePolicy != nil {
+		set["vote_policy"] = updated.VotePolicy
+	} else {
+		unset["vote_policy"] = ""
+	}
+	if updated.OpensAt != nil {
+		set["opens_at"] = updated.OpensAt
+	} else {
+		unset["opens_at"] = ""
+	}
+	if updated.ClosesAt != nil {
+		set["closes_at"] = updated.ClosesAt
+	} else {
+		unset["closes_at"] = ""
+	}
+	up := bson.M{"$set": set, "$inc": bson.M{"version": 1}}
+	if len(unset) > 0 {
+		up["$unset"] = unset
+	}
+
+	var result poll
+	err = c.FindOneAndUpdate(r.Context(), versionFilter(objID, current.Version), up,
+		options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&result)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			respondErr(w, r, http.StatusPreconditionFailed, "poll has been modified")
+		} else {
+			respondErr(w, r, http.StatusInternalServerError, "failed to update poll", err)
+		}
+		return
+	}
+	result.Status = result.currentStatus(time.Now())
+	w.Header().Set("ETag", etag(result.Version))
+	respond(w, r, http.StatusOK, &result)
+}
+
+// decodePatch applies the JSON merge patch in the request body to current
+// and decodes the result into v.
+func decodePatch(r *http.Request, current poll, v *poll) error {
+	defer r.Body.Close()
+	patch, err := io.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	doc, err := json.Marshal(current)
+	if err != nil {
+		return err
+	}
+	merged, err := mergePatch(doc, patch)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(merged, v)
+}
+
+// removedOptions returns the options in before that are missing from after.
+func removedOptions(before, after []string) []string {
+	keep := make(map[string]bool, len(after))
+	for _, option := range after {
+		keep[option] = true
+	}
+	var removed []string
+	for _, option := range before {
+		if !keep[option] {
+			removed = append(removed, option)
+		}
+	}
+	return removed
+}
+
+// versionFilter selects the poll with the given ID only while it is still
+// at the given version.
+func versionFilter(objID primitive.ObjectID, version int) bson.M {
+	if version == 0 {
+		// polls created before versioning have no version field
+		return bson.M{"_id": objID, "version": bson.M{"$in": []any{0, nil}}}
+	}
+	return bson.M{"_id": objID, "version": version}
+}
+
+// etag is the entity tag of the given poll version.
+func etag(version int) string {
+	return `"` + strconv.Itoa(version) + `"`
+}
+
+func (s *Server) handleDeletePoll(w http.ResponseWriter, r *http.Request) {
+	c := s.db.Database("ballots").Collection("polls")
+	objID, ok := pollID(w, r)
+	if !ok {
+		return
+	}
+	p, ok := s.findPoll(w, r, objID)
+	if !ok || !canModify(w, r, p) {
 		return
 	}
 	result, err := c.DeleteOne(r.Context(), bson.M{"_id": objID})
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPollValidateOptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		options []string
+		err     string
+	}{
+		{"valid", []string{"happy", "sad", "so-so"}, ""},
+		{"empty", []string{"happy", ""}, "must not be empty"},
+		{"blank", []string{"happy", "  "}, "must not be empty"},
+		{"duplicate", []string{"happy", "sad", "happy"}, "duplicate option"},
+		{"dot", []string{"happy", "a.b"}, `must not contain "."`},
+		{"dollar", []string{"$x", "happy"}, `must not start with "$"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &poll{Title: "t", Options: tt.options}
+			err := p.validate()
+			switch {
+			case tt.err == "" && err != nil:
+				t.Errorf("validate() = %v", err)
+			case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+				t.Errorf("validate() = %v, want an error containing %q", err, tt.err)
+			}
+		})
+	}
+}
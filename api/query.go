@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"maps"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	defaultPollsLimit = 50
+	maxPollsLimit     = 200
+)
+
+// pollsQuery is a page of the polls collection as requested by the query
+// string of GET /polls/:
+//
+//	limit          page size, up to maxPollsLimit
+//	cursor         opaque token from the X-Next-Cursor header of the previous page
+//	sort           created, -created, title or -title
+//	status         current poll status, see poll.currentStatus
+//	title          case insensitive title substring
+//	owner          ID of the API key that created the poll
+//	mine           "true" for only the polls created by the request's API key
+//	created_after  RFC 3339 time
+//	created_before RFC 3339 time
+type pollsQuery struct {
+	limit  int64
+	order  string // the sort parameter
+	field  string // "_id" or "title"
+	desc   bool
+	filter bson.M
+	after  *pageCursor
+}
+
+// pageCursor is the position after the last poll of a page.
+type pageCursor struct {
+	Sort  string             `json:"s"`
+	Title string             `json:"t,omitempty"`
+	ID    primitive.ObjectID `json:"id"`
+}
+
+func parsePollsQuery(q url.Values, key *apiKey, now time.Time) (*pollsQuery, error) {
+	pq := &pollsQuery{
+		limit:  defaultPollsLimit,
+		field:  "_id",
+		filter: bson.M{},
+	}
+	if l := q.Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 1 {
+			return nil, errors.New("invalid limit")
+		}
+		pq.limit = int64(min(n, maxPollsLimit))
+	}
+	sort := q.Get("sort")
+	switch strings.TrimPrefix(sort, "-") {
+	case "", "created":
+	case "title":
+		pq.field = "title"
+	default:
+		return nil, errors.New("invalid sort")
+	}
+	pq.order = sort
+	pq.desc = strings.HasPrefix(sort, "-")
+
+	if status := q.Get("status"); status != "" {
+		maps.Copy(pq.filter, statusFilter(status, now))
+	}
+	if title := q.Get("title"); title != "" {
+		pq.filter["title"] = primitive.Regex{Pattern: regexp.QuoteMeta(title), Options: "i"}
+	}
+	if owner := q.Get("owner"); owner != "" {
+		pq.filter["owner"] = owner
+	}
+	if q.Get("mine") == "true" && key != nil {
+		pq.filter["owner"] = key.ID.Hex()
+	}
+	created := bson.M{}
+	for param, op := range map[string]string{"created_after": "$gt", "created_before": "$lt"} {
+		v := q.Get(param)
+		if v == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return nil, errors.New("invalid " + param)
+		}
+		// ObjectIDs start with their creation time
+		created[op] = primitive.NewObjectIDFromTimestamp(t)
+	}
+	if len(created) > 0 {
+		pq.filter["_id"] = created
+	}
+
+	if token := q.Get("cursor"); token != "" {
+		after, err := decodeCursor(token)
+		if err != nil || after.Sort != sort {
+			return nil, errors.New("invalid cursor")
+		}
+		pq.after = after
+	}
+	return pq, nil
+}
+
+// statusFilter selects the polls whose current status is status at the
+// given time, matching poll.currentStatus: open polls become closed at
+// closes_at, and are draft until opens_at.
+func statusFilter(status string, now time.Time) bson.M {
+	// polls created before statuses existed are open
+	stored := bson.M{"$in": []any{statusOpen, nil}}
+	closed := bson.M{"$lte": now}
+	notClosed := bson.M{"$not": closed}
+	switch status {
+	case statusOpen:
+		return bson.M{
+			"status":    stored,
+			"opens_at":  bson.M{"$not": bson.M{"$gt": now}},
+			"closes_at": notClosed,
+		}
+	case statusClosed:
+		return bson.M{"$or": []bson.M{
+			{"status": statusClosed},
+			{"status": stored, "closes_at": closed},
+		}}
+	case statusDraft:
+		return bson.M{"$or": []bson.M{
+			{"status": statusDraft},
+			{"status": stored, "opens_at": bson.M{"$gt": now}, "closes_at": notClosed},
+		}}
+	default:
+		return bson.M{"status": status}
+	}
+}
+
+// find returns the filter selecting the page.
+func (pq *pollsQuery) find() bson.M {
+	if pq.after == nil {
+		return pq.filter
+	}
+	op := "$gt"
+	if pq.desc {
+		op = "$lt"
+	}
+	var position bson.M
+	if pq.field == "_id" {
+		position = bson.M{"_id": bson.M{op: pq.after.ID}}
+	} else {
+		position = bson.M{"$or": []bson.M{
+			{pq.field: bson.M{op: pq.after.Title}},
+			{pq.field: pq.after.Title, "_id": bson.M{op: pq.after.ID}},
+		}}
+	}
+	return bson.M{"$and": []bson.M{pq.filter, position}}
+}
+
+// sort returns the sort order of the page, using the ID to break ties.
+func (pq *pollsQuery) sort() bson.D {
+	dir := 1
+	if pq.desc {
+		dir = -1
+	}
+	if pq.field == "_id" {
+		return bson.D{{Key: "_id", Value: dir}}
+	}
+	return bson.D{{Key: pq.field, Value: dir}, {Key: "_id", Value: dir}}
+}
+
+// next returns the cursor for the page after the one ending with last.
+func (pq *pollsQuery) next(last *poll) string {
+	c := pageCursor{Sort: pq.order, ID: last.ID}
+	if pq.field == "title" {
+		c.Title = last.Title
+	}
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeCursor(token string) (*pageCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, err
+	}
+	var c pageCursor
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
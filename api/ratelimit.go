@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// rateLimit is a token bucket refilling Rate tokens per second up to Burst.
+type rateLimit struct {
+	Rate  float64 `bson:"rate" json:"rate"`
+	Burst int     `bson:"burst" json:"burst"`
+}
+
+func (l rateLimit) valid() bool {
+	return l.Rate > 0 && l.Burst > 0
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter keeps a token bucket per client.
+type rateLimiter struct {
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+// bucketIdle is how long a bucket is kept after its last request. Any
+// bucket idle for this long has refilled anyway.
+const bucketIdle = 10 * time.Minute
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{
+		buckets:   make(map[string]*bucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// allow takes a token from the client's bucket. It returns whether the
+// request is allowed, the tokens left, and how long until the next token
+// and a full bucket.
+func (rl *rateLimiter) allow(client string, limit rateLimit, now time.Time) (ok bool, remaining int, retryAfter, reset time.Duration) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if now.Sub(rl.lastSweep) > bucketIdle {
+		for id, b := range rl.buckets {
+			if now.Sub(b.last) > bucketIdle {
+				delete(rl.buckets, id)
+			}
+		}
+		rl.lastSweep = now
+	}
+	b, found := rl.buckets[client]
+	if !found {
+		b = &bucket{tokens: float64(limit.Burst), last: now}
+		rl.buckets[client] = b
+	}
+	b.tokens = math.Min(float64(limit.Burst), b.tokens+now.Sub(b.last).Seconds()*limit.Rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		ok = true
+	} else {
+		retryAfter = seconds((1 - b.tokens) / limit.Rate)
+	}
+	reset = seconds((float64(limit.Burst) - b.tokens) / limit.Rate)
+	return ok, int(b.tokens), retryAfter, reset
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+// rateLimits holds the limits applied to API keys and client IPs.
+type rateLimits struct {
+	key       rateLimit
+	ip        rateLimit
+	overrides map[string]rateLimit // by key ID or name
+	limiter   *rateLimiter
+}
+
+// loadRateLimitOverrides reads per-key limits from a JSON file mapping
+// key IDs or names to limits, such as {"dashboard": {"rate": 50, "burst": 100}}.
+func loadRateLimitOverrides(path string) (map[string]rateLimit, error) {
+	overrides := make(map[string]rateLimit)
+	if path == "" {
+		return overrides, nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &overrides); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for id, limit := range overrides {
+		if !limit.valid() {
+			return nil, fmt.Errorf("%s: invalid limit for %q", path, id)
+		}
+	}
+	return overrides, nil
+}
+
+// forKey returns the limit of the key: its own limit from the key store,
+// then an override from the config file, then the default.
+func (rls *rateLimits) forKey(key *apiKey) rateLimit {
+	if key.RateLimit != nil && key.RateLimit.valid() {
+		return *key.RateLimit
+	}
+	if limit, ok := rls.overrides[key.ID.Hex()]; ok {
+		return limit
+	}
+	if limit, ok := rls.overrides[key.Name]; ok {
+		return limit
+	}
+	return rls.key
+}
+
+// take checks the client against the limit, setting the X-RateLimit-*
+// headers and responding with 429 Too Many Requests if it is exhausted.
+func (rls *rateLimits) take(w http.ResponseWriter, r *http.Request, client string, limit rateLimit) bool {
+	ok, remaining, retryAfter, reset := rls.limiter.allow(client, limit, time.Now())
+	w.Header().Set("X-RateLimit-Limit", strconv.Itoa(limit.Burst))
+	w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+	w.Header().Set("X-RateLimit-Reset", strconv.Itoa(int(math.Ceil(reset.Seconds()))))
+	if !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		respondHTTPErr(w, r, http.StatusTooManyRequests)
+		return false
+	}
+	return true
+}
+
+// withIPRateLimit limits requests per client IP, before they are
+// authenticated.
+func (s *Server) withIPRateLimit(fn http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ip, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			ip = r.RemoteAddr
+		}
+		if !s.limits.take(w, r, "ip:"+ip, s.limits.ip) {
+			return
+		}
+		fn(w, r)
+	}
+}
+
+// withKeyRateLimit limits requests per API key. It must run after
+// withAPIKey.
+func (s *Server) withKeyRateLimit(fn http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key, ok := APIKey(r.Context())
+		if ok && !s.limits.take(w, r, "key:"+key.ID.Hex(), s.limits.forKey(key)) {
+			return
+		}
+		fn(w, r)
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"maps"
+	"net/http"
+	"slices"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type pollResults struct {
+	ID      string         `json:"id"`
+	Status  string         `json:"status"`
+	Type    string         `json:"type"`
+	Results map[string]int `json:"results"`
+	// Rounds and Winner are the instant-runoff count of ranked polls
+	Rounds []round `json:"rounds,omitempty"`
+	Winner string  `json:"winner,omitempty"`
+}
+
+func (s *Server) handleGetResults(w http.ResponseWriter, r *http.Request) {
+	objID, ok := pollID(w, r)
+	if !ok {
+		return
+	}
+	p, ok := s.findPoll(w, r, objID)
+	if !ok {
+		return
+	}
+	results := p.Results
+	if results == nil {
+		results = map[string]int{}
+	}
+	res := &pollResults{
+		ID:      p.ID.Hex(),
+		Status:  p.currentStatus(time.Now()),
+		Type:    p.pollType(),
+		Results: results,
+	}
+	if res.Type == typeRanked {
+		ballots, err := s.loadBallots(r.Context(), objID)
+		if err != nil {
+			respondErr(w, r, http.StatusInternalServerError, "failed to load ballots", err)
+			return
+		}
+		res.Rounds, res.Winner = instantRunoff(p.Options, ballots)
+	}
+	respond(w, r, http.StatusOK, res)
+}
+
+// heartbeatInterval is how often an idle results stream sends a comment
+// to keep proxies from closing the connection.
+const heartbeatInterval = 15 * time.Second
+
+// pollInterval is how often results are polled when change streams are
+// unavailable, such as on a standalone mongod.
+const pollInterval = 1 * time.Second
+
+// resultsEventID identifies the results of a poll by its version and a
+// hash of its counts, which change whenever the results do, even when a
+// changed vote moves a count from one option to another.
+func resultsEventID(p *poll) string {
+	h := fnv.New64a()
+	for _, option := range slices.Sorted(maps.Keys(p.Results)) {
+		fmt.Fprintf(h, "%s=%d\n", option, p.Results[option])
+	}
+	return fmt.Sprintf("%d.%x", p.Version, h.Sum64())
+}
+
+// handleStreamResults streams the results of a poll as Server-Sent Events.
+// Every event carries the full results, so a client resuming with
+// Last-Event-ID only gets an event once the results differ from the ones
+// it last saw. The stream ends when the poll is deleted.
+func (s *Server) handleStreamResults(w http.ResponseWriter, r *http.Request) {
+	objID, ok := pollID(w, r)
+	if !ok {
+		return
+	}
+	p, ok := s.findPoll(w, r, objID)
+	if !ok {
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		respondErr(w, r, http.StatusInternalServerError, "streaming not supported")
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	lastID := r.Header.Get("Last-Event-ID")
+	send := func(p *poll) error {
+		id := resultsEventID(p)
+		if id == lastID {
+			return nil
+		}
+		results := p.Results
+		if results == nil {
+			results = map[string]int{}
+		}
+		data, err := json.Marshal(&pollResults{
+			ID:      p.ID.Hex(),
+			Type:    p.pollType(),
+			Status:  p.currentStatus(time.Now()),
+			Results: results,
+		})
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "id: %s\nevent: results\ndata: %s\n\n", id, data); err != nil {
+			return err
+		}
+		flusher.Flush()
+		lastID = id
+		return nil
+	}
+	if err := send(p); err != nil {
+		return
+	}
+
+	updates := s.watchPoll(r.Context(), objID)
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			if _, err := io.WriteString(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case p, ok := <-updates:
+			if !ok {
+				return
+			}
+			if err := send(p); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// watchPoll sends the poll every time it changes until ctx is done, using
+// a change stream if possible and polling otherwise. The channel is
+// closed when the poll is deleted or ctx is done.
+func (s *Server) watchPoll(ctx context.Context, objID primitive.ObjectID) <-chan *poll {
+	c := s.db.Database("ballots").Collection("polls")
+	updates := make(chan *poll)
+	go func() {
+		defer close(updates)
+		pipeline := mongo.Pipeline{{{Key: "$match", Value: bson.D{{Key: "documentKey._id", Value: objID}}}}}
+		cs, err := c.Watch(ctx, pipeline, options.ChangeStream().SetFullDocument(options.UpdateLookup))
+		if err == nil {
+			deleted := streamPoll(ctx, cs, updates)
+			cs.Close(context.Background())
+			if deleted || ctx.Err() != nil {
+				return
+			}
+			err = cs.Err()
+		}
+		log.Println("change stream unavailable, polling for results:", err)
+		ticker := time.NewTicker(pollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			var p poll
+			err := c.FindOne(ctx, bson.M{"_id": objID}).Decode(&p)
+			if err == mongo.ErrNoDocuments {
+				return
+			}
+			if err != nil {
+				continue
+			}
+			select {
+			case updates <- &p:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return updates
+}
+
+// streamPoll sends the poll from every change event until the change
+// stream fails, returning whether the poll was deleted.
+func streamPoll(ctx context.Context, cs *mongo.ChangeStream, updates chan<- *poll) bool {
+	for cs.Next(ctx) {
+		var event struct {
+			OperationType string `bson:"operationType"`
+			FullDocument  *poll  `bson:"fullDocument"`
+		}
+		if err := cs.Decode(&event); err != nil {
+			continue
+		}
+		if event.OperationType == "delete" {
+			return true
+		}
+		if event.FullDocument == nil {
+			continue
+		}
+		select {
+		case updates <- event.FullDocument:
+		case <-ctx.Done():
+			return false
+		}
+	}
+	return false
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const PathSeparator = "/"
+
+// Router dispatches requests by method and path pattern.
+//
+// Patterns are PathSeparator separated segments such as "polls/{id}/results",
+// where a "{name}" segment matches any single path segment and is available
+// to the handler through r.PathValue(name). Requests for an unknown path get
+// a 404, and requests for a known path with an unsupported method get a 405.
+type Router struct {
+	routes []*route
+}
+
+type route struct {
+	segments []string
+	handlers map[string]http.HandlerFunc
+	methods  []string
+}
+
+func NewRouter() *Router {
+	return &Router{}
+}
+
+// Handle registers fn for requests with the given method and path pattern.
+func (rt *Router) Handle(method, pattern string, fn http.HandlerFunc) {
+	segments := splitPath(pattern)
+	for _, rte := range rt.routes {
+		if strings.Join(rte.segments, PathSeparator) == strings.Join(segments, PathSeparator) {
+			rte.handlers[method] = fn
+			rte.methods = append(rte.methods, method)
+			return
+		}
+	}
+	rt.routes = append(rt.routes, &route{
+		segments: segments,
+		handlers: map[string]http.HandlerFunc{method: fn},
+		methods:  []string{method},
+	})
+}
+
+func (rt *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	segments := splitPath(r.URL.EscapedPath())
+	for _, rte := range rt.routes {
+		params, ok := rte.match(segments)
+		if !ok {
+			continue
+		}
+		allow := strings.Join(rte.methods, ", ")
+		if r.Method == http.MethodOptions {
+			// CORS preflight
+			w.Header().Set("Access-Control-Allow-Methods", allow)
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, X-API-Key, If-Match")
+			respond(w, r, http.StatusOK, nil)
+			return
+		}
+		fn, ok := rte.handlers[r.Method]
+		if !ok {
+			w.Header().Set("Allow", allow)
+			respondHTTPErr(w, r, http.StatusMethodNotAllowed)
+			return
+		}
+		for name, value := range params {
+			r.SetPathValue(name, value)
+		}
+		fn(w, r)
+		return
+	}
+	respondHTTPErr(w, r, http.StatusNotFound)
+}
+
+// match reports whether the path segments match the route, returning the
+// values of its named segments.
+func (rte *route) match(segments []string) (map[string]string, bool) {
+	if len(segments) != len(rte.segments) {
+		return nil, false
+	}
+	params := make(map[string]string)
+	for i, seg := range rte.segments {
+		if strings.HasPrefix(seg, "{") && strings.HasSuffix(seg, "}") {
+			value, err := url.PathUnescape(segments[i])
+			if err != nil {
+				return nil, false
+			}
+			params[seg[1:len(seg)-1]] = value
+			continue
+		}
+		if seg != segments[i] {
+			return nil, false
+		}
+	}
+	return params, true
+}
+
+func splitPath(p string) []string {
+	p = strings.Trim(p, PathSeparator)
+	if p == "" {
+		return nil
+	}
+	return strings.Split(p, PathSeparator)
+}
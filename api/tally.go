@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"slices"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ballot is a ranked-choice ballot as the counter stores it in the
+// ballots collection.
+type ballot struct {
+	Ranking []string `bson:"ranking"`
+	Weight  int      `bson:"weight"`
+}
+
+// round is a round of an instant-runoff count.
+type round struct {
+	Counts     map[string]int `json:"counts"`
+	Eliminated string         `json:"eliminated,omitempty"`
+}
+
+// instantRunoff counts the ballots in rounds. Each round counts every
+// ballot for its highest ranked option still standing, and eliminates the
+// option with the fewest votes until one has a majority of the ballots
+// still counting. Ties for elimination go to the option with the fewest
+// votes in the earliest round where they differ, and then to the option
+// listed last in the poll.
+func instantRunoff(options []string, ballots []ballot) ([]round, string) {
+	standing := slices.Clone(options)
+	var rounds []round
+	for len(standing) > 0 {
+		counts := make(map[string]int, len(standing))
+		for _, option := range standing {
+			counts[option] = 0
+		}
+		var total int
+		for _, b := range ballots {
+			for _, option := range b.Ranking {
+				if _, ok := counts[option]; ok {
+					counts[option] += max(b.Weight, 1)
+					total += max(b.Weight, 1)
+					break
+				}
+			}
+		}
+		rounds = append(rounds, round{Counts: counts})
+		for _, option := range standing {
+			if total > 0 && counts[option]*2 > total {
+				return rounds, option
+			}
+		}
+		if len(standing) == 1 {
+			// only happens without any ballots left
+			return rounds, ""
+		}
+		loser := standing[len(standing)-1]
+		for _, option := range slices.Backward(standing[:len(standing)-1]) {
+			if fewerVotes(rounds, option, loser) {
+				loser = option
+			}
+		}
+		rounds[len(rounds)-1].Eliminated = loser
+		standing = slices.DeleteFunc(standing, func(o string) bool { return o == loser })
+	}
+	return rounds, ""
+}
+
+// fewerVotes reports whether a had fewer votes than b in the last round,
+// or failing that in the earliest round where they differ.
+func fewerVotes(rounds []round, a, b string) bool {
+	last := rounds[len(rounds)-1]
+	if last.Counts[a] != last.Counts[b] {
+		return last.Counts[a] < last.Counts[b]
+	}
+	for _, r := range rounds {
+		if r.Counts[a] != r.Counts[b] {
+			return r.Counts[a] < r.Counts[b]
+		}
+	}
+	return false
+}
+
+// loadBallots loads the ranked-choice ballots of a poll.
+func (s *Server) loadBallots(ctx context.Context, objID primitive.ObjectID) ([]ballot, error) {
+	c := s.db.Database("ballots").Collection("ballots")
+	cursor, err := c.Find(ctx, bson.M{"poll_id": objID.Hex()})
+	if err != nil {
+		return nil, err
+	}
+	var ballots []ballot
+	if err := cursor.All(ctx, &ballots); err != nil {
+		return nil, err
+	}
+	return ballots, nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestInstantRunoff(t *testing.T) {
+	tests := []struct {
+		name    string
+		options []string
+		ballots []ballot
+		rounds  []round
+		winner  string
+	}{
+		{
+			name:    "majority",
+			options: []string{"a", "b", "c"},
+			ballots: []ballot{
+				{Ranking: []string{"a"}},
+				{Ranking: []string{"a", "b"}},
+				{Ranking: []string{"b"}},
+			},
+			rounds: []round{
+				{Counts: map[string]int{"a": 2, "b": 1, "c": 0}},
+			},
+			winner: "a",
+		},
+		{
+			name:    "elimination",
+			options: []string{"a", "b", "c"},
+			ballots: []ballot{
+				{Ranking: []string{"a"}, Weight: 2},
+				{Ranking: []string{"b"}, Weight: 2},
+				{Ranking: []string{"c", "b"}},
+			},
+			rounds: []round{
+				{Counts: map[string]int{"a": 2, "b": 2, "c": 1}, Eliminated: "c"},
+				{Counts: map[string]int{"a": 2, "b": 3}},
+			},
+			winner: "b",
+		},
+		{
+			name:    "tie listed last",
+			options: []string{"a", "b", "c"},
+			ballots: []ballot{
+				{Ranking: []string{"a"}, Weight: 2},
+				{Ranking: []string{"b", "a"}},
+				{Ranking: []string{"c"}},
+			},
+			rounds: []round{
+				{Counts: map[string]int{"a": 2, "b": 1, "c": 1}, Eliminated: "c"},
+				{Counts: map[string]int{"a": 2, "b": 1}},
+			},
+			winner: "a",
+		},
+		{
+			name:    "tie earliest round",
+			options: []string{"a", "c", "b", "d"},
+			ballots: []ballot{
+				{Ranking: []string{"a"}, Weight: 5},
+				{Ranking: []string{"b"}, Weight: 3},
+				{Ranking: []string{"c"}, Weight: 2},
+				{Ranking: []string{"d", "c"}},
+			},
+			rounds: []round{
+				{Counts: map[string]int{"a": 5, "b": 3, "c": 2, "d": 1}, Eliminated: "d"},
+				{Counts: map[string]int{"a": 5, "b": 3, "c": 3}, Eliminated: "c"},
+				{Counts: map[string]int{"a": 5, "b": 3}},
+			},
+			winner: "a",
+		},
+		{
+			name:    "exhausted",
+			options: []string{"a", "b"},
+			ballots: []ballot{
+				{Ranking: []string{"removed"}},
+			},
+			rounds: []round{
+				{Counts: map[string]int{"a": 0, "b": 0}, Eliminated: "b"},
+				{Counts: map[string]int{"a": 0}},
+			},
+			winner: "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rounds, winner := instantRunoff(tt.options, tt.ballots)
+			if winner != tt.winner {
+				t.Errorf("winner = %q, want %q", winner, tt.winner)
+			}
+			if !reflect.DeepEqual(rounds, tt.rounds) {
+				t.Errorf("rounds = %+v, want %+v", rounds, tt.rounds)
+			}
+		})
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/liyu-wang/go-socialpoll/broker"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const sourceAPI = "api"
+
+const (
+	defaultVotesLimit = 50
+	maxVotesLimit     = 500
+)
+
+// recordedVote is a vote the counter has counted for a poll.
+type recordedVote struct {
+	PollID    string    `bson:"poll_id" json:"poll_id"`
+	Option    string    `bson:"option" json:"option"`
+	Options   []string  `bson:"options,omitempty" json:"options,omitempty"`
+	Weight    int       `bson:"weight,omitempty" json:"weight,omitempty"`
+	Flags     []string  `bson:"flags,omitempty" json:"flags,omitempty"`
+	Source    string    `bson:"source" json:"source"`
+	AuthorID  string    `bson:"author_id,omitempty" json:"author_id,omitempty"`
+	MessageID string    `bson:"message_id,omitempty" json:"message_id,omitempty"`
+	Timestamp time.Time `bson:"timestamp" json:"timestamp"`
+}
+
+// handleListVotes lists the most recent votes recorded for a poll,
+// newest first. The number of votes is set by ?limit=.
+func (s *Server) handleListVotes(w http.ResponseWriter, r *http.Request) {
+	c := s.db.Database("ballots").Collection("votes")
+	objID, ok := pollID(w, r)
+	if !ok {
+		return
+	}
+	if _, ok := s.findPoll(w, r, objID); !ok {
+		return
+	}
+	limit := defaultVotesLimit
+	if l := r.URL.Query().Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 1 {
+			respondErr(w, r, http.StatusBadRequest, "invalid limit")
+			return
+		}
+		limit = min(n, maxVotesLimit)
+	}
+	opts := options.Find().
+		SetSort(bson.D{{Key: "timestamp", Value: -1}}).
+		SetLimit(int64(limit))
+	cursor, err := c.Find(r.Context(), bson.M{"poll_id": objID.Hex()}, opts)
+	if err != nil {
+		respondErr(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	defer cursor.Close(r.Context())
+	result := []*recordedVote{}
+	if err := cursor.All(r.Context(), &result); err != nil {
+		respondErr(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	respond(w, r, http.StatusOK, &result)
+}
+
+// castVote is the response to casting a vote.
+type castVote struct {
+	ID string `json:"id"`
+}
+
+// handleCastVote validates a vote and publishes it to the "votes" topic
+// for the counter. The vote is counted asynchronously, so the response is
+// 202 Accepted with the vote ID, which is the message ID of the recorded
+// vote. Votes are attributed to the API key, and to the optional voter the
+// client identifies within it.
+//
+// Approval polls take the approved options and ranked-choice polls the
+// options in order of preference as "options". Weighted polls take a
+// "weight", which only keys with the write scope may set.
+func (s *Server) handleCastVote(w http.ResponseWriter, r *http.Request) {
+	objID, ok := pollID(w, r)
+	if !ok {
+		return
+	}
+	var body struct {
+		Option  string   `json:"option"`
+		Options []string `json:"options"`
+		Weight  int      `json:"weight"`
+		Voter   string   `json:"voter"`
+	}
+	if err := decodeBody(r, &body); err != nil {
+		respondErr(w, r, http.StatusBadRequest, "failed to read vote from request", err)
+		return
+	}
+	p, ok := s.findPoll(w, r, objID)
+	if !ok {
+		return
+	}
+	if status := p.currentStatus(time.Now()); status != statusOpen {
+		respondErr(w, r, http.StatusConflict, fmt.Sprintf("poll is %s", status))
+		return
+	}
+	key, _ := APIKey(r.Context())
+	ballot, err := validBallot(p, body.Option, body.Options)
+	if err != nil {
+		respondErr(w, r, http.StatusBadRequest, err)
+		return
+	}
+	if body.Weight != 0 {
+		if p.pollType() != typeWeighted {
+			respondErr(w, r, http.StatusBadRequest, "only weighted polls take a weight")
+			return
+		}
+		if body.Weight < 1 {
+			respondErr(w, r, http.StatusBadRequest, "weight must be positive")
+			return
+		}
+		if !key.HasScope(scopeWrite) {
+			respondErr(w, r, http.StatusForbidden, "API key lacks the "+scopeWrite+" scope to weight votes")
+			return
+		}
+	}
+	author := key.ID.Hex()
+	if body.Voter != "" {
+		author += "/" + body.Voter
+	}
+	v := broker.Vote{
+		Version:   broker.VoteVersion,
+		PollID:    objID.Hex(),
+		Option:    ballot[0],
+		Weight:    body.Weight,
+		Source:    sourceAPI,
+		AuthorID:  author,
+		MessageID: primitive.NewObjectID().Hex(),
+		Timestamp: time.Now().UTC(),
+	}
+	if len(ballot) > 1 {
+		v.Options = ballot
+	}
+	msg, err := v.Encode()
+	if err != nil {
+		respondErr(w, r, http.StatusInternalServerError, "failed to encode vote", err)
+		return
+	}
+	if err := s.votes.Publish("votes", msg); err != nil {
+		log.Println("failed to publish vote:", err)
+		respondErr(w, r, http.StatusServiceUnavailable, "failed to publish vote")
+		return
+	}
+	respond(w, r, http.StatusAccepted, &castVote{ID: v.MessageID})
+}
+
+// validBallot returns the options of a vote, which is either a single
+// option or, for approval and ranked-choice polls, a list of distinct
+// options.
+func validBallot(p *poll, option string, options []string) ([]string, error) {
+	if option != "" && len(options) > 0 {
+		return nil, errors.New("either option or options is required, not both")
+	}
+	if option != "" {
+		options = []string{option}
+	}
+	if len(options) == 0 {
+		return nil, errors.New("option is required")
+	}
+	if len(options) > 1 && p.pollType() != typeApproval && p.pollType() != typeRanked {
+		return nil, fmt.Errorf("%s polls take a single option", p.pollType())
+	}
+	for i, option := range options {
+		if !slices.Contains(p.Options, option) {
+			return nil, fmt.Errorf("unknown option %q", option)
+		}
+		if slices.Contains(options[:i], option) {
+			return nil, fmt.Errorf("duplicate option %q", option)
+		}
+	}
+	return options, nil
+}
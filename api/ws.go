@@ -0,0 +1,332 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	// wsWriteWait is how long a write to a client may take before the
+	// client is considered stuck and disconnected.
+	wsWriteWait = 10 * time.Second
+	// wsPongWait is how long a client may stay silent, including pongs.
+	wsPongWait = 60 * time.Second
+	// wsPingInterval must be shorter than wsPongWait.
+	wsPingInterval = 30 * time.Second
+	// wsStatusInterval is how often subscribed polls are checked for
+	// opening or closing as their voting window passes.
+	wsStatusInterval = 1 * time.Second
+	// wsMaxSubscriptions is the most polls a connection can subscribe to.
+	wsMaxSubscriptions = 50
+)
+
+var upgrader = websocket.Upgrader{
+	// the API allows any origin, see withCORS
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// wsRequest is a message from a client.
+type wsRequest struct {
+	Type  string   `json:"type"` // subscribe or unsubscribe
+	Polls []string `json:"polls"`
+}
+
+// wsEvent is a message to a client.
+//
+//	snapshot  full results and status, sent on subscribing and whenever
+//	          options are changed
+//	delta     change in results since the previous snapshot or delta
+//	status    poll status changed
+//	deleted   poll was deleted, the subscription has ended
+//	error     request could not be handled
+type wsEvent struct {
+	Type    string         `json:"type"`
+	Poll    string         `json:"poll,omitempty"`
+	Status  string         `json:"status,omitempty"`
+	Results map[string]int `json:"results,omitempty"`
+	Delta   map[string]int `json:"delta,omitempty"`
+	Message string         `json:"message,omitempty"`
+}
+
+// wsConn is a client connection. Watchers of subscribed polls only store
+// the latest version of each poll and signal the writer, so a slow client
+// receives coalesced deltas instead of holding up the watchers.
+type wsConn struct {
+	s    *Server
+	ws   *websocket.Conn
+	ctx  context.Context
+	stop context.CancelFunc
+
+	mu      sync.Mutex
+	subs    map[primitive.ObjectID]context.CancelFunc
+	pending map[primitive.ObjectID]*poll // latest unsent version of each poll
+	fresh   map[primitive.ObjectID]bool  // new subscriptions, owed a snapshot
+	deleted []primitive.ObjectID
+	errors  []string
+	notify  chan struct{}
+
+	// owned by the writer
+	sent       map[primitive.ObjectID]*poll
+	sentStatus map[primitive.ObjectID]string
+}
+
+// handleWS upgrades the request to a websocket feeding results and
+// lifecycle events of the polls the client subscribes to.
+func (s *Server) handleWS(w http.ResponseWriter, r *http.Request) {
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// the upgrader has already responded
+		return
+	}
+	ctx, stop := context.WithCancel(context.Background())
+	c := &wsConn{
+		s:          s,
+		ws:         ws,
+		ctx:        ctx,
+		stop:       stop,
+		subs:       make(map[primitive.ObjectID]context.CancelFunc),
+		pending:    make(map[primitive.ObjectID]*poll),
+		fresh:      make(map[primitive.ObjectID]bool),
+		notify:     make(chan struct{}, 1),
+		sent:       make(map[primitive.ObjectID]*poll),
+		sentStatus: make(map[primitive.ObjectID]string),
+	}
+	go c.writeLoop()
+	c.readLoop()
+}
+
+func (c *wsConn) readLoop() {
+	defer c.stop()
+	c.ws.SetReadLimit(4096)
+	c.ws.SetReadDeadline(time.Now().Add(wsPongWait))
+	c.ws.SetPongHandler(func(string) error {
+		return c.ws.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+	for {
+		var req wsRequest
+		if err := c.ws.ReadJSON(&req); err != nil {
+			return
+		}
+		c.ws.SetReadDeadline(time.Now().Add(wsPongWait))
+		if req.Type != "subscribe" && req.Type != "unsubscribe" {
+			c.fail("unknown request type " + req.Type)
+			continue
+		}
+		for _, id := range req.Polls {
+			if req.Type == "subscribe" {
+				c.subscribe(id)
+			} else {
+				c.unsubscribe(id)
+			}
+		}
+	}
+}
+
+func (c *wsConn) subscribe(id string) {
+	objID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		c.fail("invalid poll ID format: " + id)
+		return
+	}
+	c.mu.Lock()
+	_, subscribed := c.subs[objID]
+	full := len(c.subs) >= wsMaxSubscriptions
+	c.mu.Unlock()
+	if subscribed {
+		return
+	}
+	if full {
+		c.fail("too many subscriptions")
+		return
+	}
+	p, err := c.s.loadPoll(c.ctx, objID)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			c.fail("poll not found: " + id)
+		} else {
+			c.fail("failed to load poll: " + id)
+		}
+		return
+	}
+	ctx, cancel := context.WithCancel(c.ctx)
+	c.mu.Lock()
+	c.subs[objID] = cancel
+	c.fresh[objID] = true
+	c.mu.Unlock()
+	c.update(objID, p)
+
+	go func() {
+		for p := range c.s.watchPoll(ctx, objID) {
+			c.update(objID, p)
+		}
+		if ctx.Err() == nil {
+			// the watch ended without being cancelled, so the poll is gone
+			c.mu.Lock()
+			delete(c.subs, objID)
+			delete(c.pending, objID)
+			c.deleted = append(c.deleted, objID)
+			c.mu.Unlock()
+			c.signal()
+		}
+		cancel()
+	}()
+}
+
+func (c *wsConn) unsubscribe(id string) {
+	objID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		c.fail("invalid poll ID format: " + id)
+		return
+	}
+	c.mu.Lock()
+	if cancel, ok := c.subs[objID]; ok {
+		cancel()
+		delete(c.subs, objID)
+		delete(c.pending, objID)
+	}
+	c.mu.Unlock()
+	c.signal()
+}
+
+func (c *wsConn) update(objID primitive.ObjectID, p *poll) {
+	c.mu.Lock()
+	if _, ok := c.subs[objID]; ok {
+		c.pending[objID] = p
+	}
+	c.mu.Unlock()
+	c.signal()
+}
+
+func (c *wsConn) fail(message string) {
+	c.mu.Lock()
+	c.errors = append(c.errors, message)
+	c.mu.Unlock()
+	c.signal()
+}
+
+func (c *wsConn) signal() {
+	select {
+	case c.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (c *wsConn) writeLoop() {
+	defer c.ws.Close()
+	ping := time.NewTicker(wsPingInterval)
+	defer ping.Stop()
+	status := time.NewTicker(wsStatusInterval)
+	defer status.Stop()
+	for {
+		var events []wsEvent
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-ping.C:
+			c.ws.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := c.ws.WriteMessage(websocket.PingMessage, nil); err != nil {
+				c.stop()
+				return
+			}
+			continue
+		case <-status.C:
+			events = c.statusEvents()
+		case <-c.notify:
+			events = c.drain()
+		}
+		for _, event := range events {
+			c.ws.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := c.ws.WriteJSON(event); err != nil {
+				log.Println("dropping websocket client:", err)
+				c.stop()
+				return
+			}
+		}
+	}
+}
+
+// drain turns everything that happened since the last drain into events.
+func (c *wsConn) drain() []wsEvent {
+	c.mu.Lock()
+	pending, deleted, failures := c.pending, c.deleted, c.errors
+	c.pending = make(map[primitive.ObjectID]*poll)
+	c.deleted, c.errors = nil, nil
+	for objID := range c.sent {
+		if c.fresh[objID] || (c.subs[objID] == nil && !slices.Contains(deleted, objID)) {
+			// unsubscribed, or subscribed again
+			delete(c.sent, objID)
+			delete(c.sentStatus, objID)
+		}
+	}
+	clear(c.fresh)
+	c.mu.Unlock()
+
+	var events []wsEvent
+	for _, message := range failures {
+		events = append(events, wsEvent{Type: "error", Message: message})
+	}
+	now := time.Now()
+	for objID, p := range pending {
+		events = append(events, c.diff(objID, p, now)...)
+		c.sent[objID] = p
+	}
+	for _, objID := range deleted {
+		delete(c.sent, objID)
+		delete(c.sentStatus, objID)
+		events = append(events, wsEvent{Type: "deleted", Poll: objID.Hex()})
+	}
+	return events
+}
+
+// diff returns the events taking the client from the last poll it was
+// sent to p.
+func (c *wsConn) diff(objID primitive.ObjectID, p *poll, now time.Time) []wsEvent {
+	status := p.currentStatus(now)
+	prevStatus := c.sentStatus[objID]
+	c.sentStatus[objID] = status
+	prev, ok := c.sent[objID]
+	if !ok || prev.Version != p.Version {
+		results := p.Results
+		if results == nil {
+			results = map[string]int{}
+		}
+		return []wsEvent{{Type: "snapshot", Poll: objID.Hex(), Status: status, Results: results}}
+	}
+	var events []wsEvent
+	delta := make(map[string]int)
+	for option, n := range p.Results {
+		if d := n - prev.Results[option]; d != 0 {
+			delta[option] = d
+		}
+	}
+	if len(delta) > 0 {
+		events = append(events, wsEvent{Type: "delta", Poll: objID.Hex(), Delta: delta})
+	}
+	if status != prevStatus {
+		events = append(events, wsEvent{Type: "status", Poll: objID.Hex(), Status: status})
+	}
+	return events
+}
+
+// statusEvents reports polls whose voting window opened or closed since
+// they were last sent.
+func (c *wsConn) statusEvents() []wsEvent {
+	now := time.Now()
+	var events []wsEvent
+	for objID, p := range c.sent {
+		status := p.currentStatus(now)
+		if status != c.sentStatus[objID] {
+			c.sentStatus[objID] = status
+			events = append(events, wsEvent{Type: "status", Poll: objID.Hex(), Status: status})
+		}
+	}
+	return events
+}
@@ -0,0 +1,105 @@
+// Package broker carries messages between the socialpoll services over
+// NSQ, NATS JetStream, Redis Streams, or channels within a single process.
+package broker
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+)
+
+// broker kinds
+const (
+	KindNSQ    = "nsq"
+	KindNATS   = "nats"
+	KindRedis  = "redis"
+	KindInproc = "inproc" // channels within one process, for development
+)
+
+// redeliverDelay is how long a message whose handler failed waits before
+// it is delivered again.
+const redeliverDelay = 5 * time.Second
+
+// publishTimeout bounds how long a publish may wait for the broker.
+const publishTimeout = 5 * time.Second
+
+// ackTimeout bounds how long acknowledging handled messages may wait for
+// the broker.
+const ackTimeout = 5 * time.Second
+
+// Handler handles the body of a message. A message whose handler fails is
+// delivered again later.
+type Handler func(body []byte) error
+
+// Publisher publishes messages to topics.
+type Publisher interface {
+	Publish(topic string, body []byte) error
+	Close() error
+}
+
+// Consumer delivers the messages of a topic to a handler. Every group
+// receives every message, and the consumers of a group share them.
+type Consumer interface {
+	// Consume delivers messages to h until ctx is done.
+	Consume(ctx context.Context, topic, group string, h Handler) error
+}
+
+// Config selects the broker and where to find it.
+type Config struct {
+	Kind string
+	// Addr is the address of the broker, or empty for the default of its
+	// kind. NSQ publishers connect to nsqd and consumers to nsqlookupd.
+	Addr string
+}
+
+// Flags registers the -broker and -broker-addr flags on fs, defaulting to
+// the SP_BROKER and SP_BROKER__ADDR environment variables.
+func Flags(fs *flag.FlagSet) *Config {
+	c := &Config{}
+	kind := os.Getenv("SP_BROKER")
+	if kind == "" {
+		kind = KindNSQ
+	}
+	fs.StringVar(&c.Kind, "broker", kind, "message broker: nsq, nats, redis or inproc")
+	fs.StringVar(&c.Addr, "broker-addr", os.Getenv("SP_BROKER__ADDR"), "broker address, empty for the default of the broker (nsqd localhost:4150 to publish, nsqlookupd localhost:4161 to consume, nats://localhost:4222, localhost:6379)")
+	return c
+}
+
+// NewPublisher connects a publisher to the configured broker.
+func NewPublisher(c Config) (Publisher, error) {
+	switch c.Kind {
+	case KindNSQ:
+		return newNSQPublisher(addrOr(c.Addr, "localhost:4150"))
+	case KindNATS:
+		return newNATSPublisher(addrOr(c.Addr, "nats://localhost:4222"))
+	case KindRedis:
+		return newRedisPublisher(addrOr(c.Addr, "localhost:6379"))
+	case KindInproc:
+		return inprocPublisher{}, nil
+	}
+	return nil, fmt.Errorf("unknown broker %q", c.Kind)
+}
+
+// NewConsumer connects a consumer to the configured broker.
+func NewConsumer(c Config) (Consumer, error) {
+	switch c.Kind {
+	case KindNSQ:
+		return nsqConsumer{lookupd: addrOr(c.Addr, "localhost:4161")}, nil
+	case KindNATS:
+		return newNATSConsumer(addrOr(c.Addr, "nats://localhost:4222"))
+	case KindRedis:
+		return newRedisConsumer(addrOr(c.Addr, "localhost:6379"))
+	case KindInproc:
+		return inprocConsumer{}, nil
+	}
+	return nil, fmt.Errorf("unknown broker %q", c.Kind)
+}
+
+func addrOr(addr, def string) string {
+	if addr == "" {
+		return def
+	}
+	return addr
+}
@@ -0,0 +1,110 @@
+package broker
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// inprocBuffer is how many messages each group of an in-process topic
+// holds before publishing to it fails.
+const inprocBuffer = 4096
+
+// bus is the in-process broker shared by every inproc publisher and
+// consumer of the process. Messages are lost when the process stops.
+var bus = struct {
+	sync.Mutex
+	topics map[string]*inprocTopic
+}{topics: make(map[string]*inprocTopic)}
+
+type inprocTopic struct {
+	groups map[string]chan []byte
+	// backlog holds the messages published before any group consumed
+	// the topic, for the first group to consume it, as nsqd does
+	backlog [][]byte
+}
+
+func inprocTopicLocked(name string) *inprocTopic {
+	t, ok := bus.topics[name]
+	if !ok {
+		t = &inprocTopic{groups: make(map[string]chan []byte)}
+		bus.topics[name] = t
+	}
+	return t
+}
+
+type inprocPublisher struct{}
+
+func (inprocPublisher) Publish(topic string, body []byte) error {
+	bus.Lock()
+	defer bus.Unlock()
+	t := inprocTopicLocked(topic)
+	if len(t.groups) == 0 {
+		if len(t.backlog) >= inprocBuffer {
+			return fmt.Errorf("in-process topic %s is full", topic)
+		}
+		t.backlog = append(t.backlog, body)
+		return nil
+	}
+	var full []string
+	for group, ch := range t.groups {
+		select {
+		case ch <- body:
+		default:
+			full = append(full, group)
+		}
+	}
+	if len(full) > 0 {
+		return fmt.Errorf("in-process topic %s is full for %q", topic, full)
+	}
+	return nil
+}
+
+func (inprocPublisher) Close() error {
+	return nil
+}
+
+type inprocConsumer struct{}
+
+func (inprocConsumer) Consume(ctx context.Context, topic, group string, h Handler) error {
+	bus.Lock()
+	t := inprocTopicLocked(topic)
+	ch, ok := t.groups[group]
+	if !ok {
+		ch = make(chan []byte, inprocBuffer)
+		for _, body := range t.backlog {
+			ch <- body
+		}
+		t.backlog = nil
+		t.groups[group] = ch
+	}
+	bus.Unlock()
+	for {
+		select {
+		case <-ctx.Done():
+			// hand over what is buffered, which would be lost otherwise
+			for {
+				select {
+				case body := <-ch:
+					if err := h(body); err != nil {
+						log.Printf("broker: dropping message of %s for %s as it stops: %v", topic, group, err)
+					}
+				default:
+					return nil
+				}
+			}
+		case body := <-ch:
+			if err := h(body); err != nil {
+				time.AfterFunc(redeliverDelay, func() {
+					select {
+					case ch <- body:
+					default:
+						log.Printf("broker: dropping message of %s, the in-process queue of %s is full", topic, group)
+					}
+				})
+			}
+		}
+	}
+}
@@ -0,0 +1,26 @@
+package broker
+
+import (
+	"context"
+	"testing"
+)
+
+func TestInprocConsumeDrainsWhenStopped(t *testing.T) {
+	pub, _ := NewPublisher(Config{Kind: KindInproc})
+	cons, _ := NewConsumer(Config{Kind: KindInproc})
+	for range 10 {
+		if err := pub.Publish("drain", []byte("vote")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	var n int
+	cons.Consume(ctx, "drain", "counter", func([]byte) error {
+		n++
+		return nil
+	})
+	if n != 10 {
+		t.Errorf("handled %d messages, want 10", n)
+	}
+}
@@ -0,0 +1,128 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// Each topic is a subject stored in a JetStream stream. An existing stream
+// holding the subject is used as it is, and otherwise a stream named after
+// the topic is created with the server's defaults.
+
+func dialNATS(url string) (jetstream.JetStream, error) {
+	nc, err := nats.Connect(url, nats.Name("socialpoll"), nats.MaxReconnects(-1))
+	if err != nil {
+		return nil, err
+	}
+	js, err := jetstream.New(nc)
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+	return js, nil
+}
+
+// ensureStream returns the name of the stream holding the topic, creating
+// it if there is none.
+func ensureStream(ctx context.Context, js jetstream.JetStream, topic string) (string, error) {
+	name, err := js.StreamNameBySubject(ctx, topic)
+	if err == nil {
+		return name, nil
+	}
+	if !errors.Is(err, jetstream.ErrStreamNotFound) {
+		return "", err
+	}
+	name = strings.ToUpper(topic)
+	_, err = js.CreateStream(ctx, jetstream.StreamConfig{Name: name, Subjects: []string{topic}})
+	if errors.Is(err, jetstream.ErrStreamNameAlreadyInUse) {
+		// created by another service meanwhile
+		err = nil
+	}
+	return name, err
+}
+
+type natsPublisher struct {
+	js jetstream.JetStream
+
+	mu      sync.Mutex
+	streams map[string]bool // topics known to have a stream
+}
+
+func newNATSPublisher(url string) (*natsPublisher, error) {
+	js, err := dialNATS(url)
+	if err != nil {
+		return nil, err
+	}
+	return &natsPublisher{js: js, streams: make(map[string]bool)}, nil
+}
+
+func (p *natsPublisher) Publish(topic string, body []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), publishTimeout)
+	defer cancel()
+	p.mu.Lock()
+	ok := p.streams[topic]
+	p.mu.Unlock()
+	if !ok {
+		if _, err := ensureStream(ctx, p.js, topic); err != nil {
+			return err
+		}
+		p.mu.Lock()
+		p.streams[topic] = true
+		p.mu.Unlock()
+	}
+	_, err := p.js.Publish(ctx, topic, body)
+	return err
+}
+
+func (p *natsPublisher) Close() error {
+	return p.js.Conn().Drain()
+}
+
+// natsConsumer consumes a topic through a durable consumer named after
+// the group.
+type natsConsumer struct {
+	js jetstream.JetStream
+}
+
+func newNATSConsumer(url string) (*natsConsumer, error) {
+	js, err := dialNATS(url)
+	if err != nil {
+		return nil, err
+	}
+	return &natsConsumer{js: js}, nil
+}
+
+func (c *natsConsumer) Consume(ctx context.Context, topic, group string, h Handler) error {
+	defer c.js.Conn().Close()
+	stream, err := ensureStream(ctx, c.js, topic)
+	if err != nil {
+		return err
+	}
+	cons, err := c.js.CreateOrUpdateConsumer(ctx, stream, jetstream.ConsumerConfig{
+		Durable:       group,
+		FilterSubject: topic,
+		AckPolicy:     jetstream.AckExplicitPolicy,
+	})
+	if err != nil {
+		return err
+	}
+	cc, err := cons.Consume(func(m jetstream.Msg) {
+		if err := h(m.Data()); err != nil {
+			m.NakWithDelay(redeliverDelay)
+			return
+		}
+		m.Ack()
+	})
+	if err != nil {
+		return err
+	}
+	<-ctx.Done()
+	cc.Drain()
+	<-cc.Closed()
+	return nil
+}
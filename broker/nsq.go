@@ -0,0 +1,53 @@
+package broker
+
+import (
+	"context"
+
+	"github.com/nsqio/go-nsq"
+)
+
+type nsqPublisher struct {
+	p *nsq.Producer
+}
+
+func newNSQPublisher(nsqd string) (*nsqPublisher, error) {
+	p, err := nsq.NewProducer(nsqd, nsq.NewConfig())
+	if err != nil {
+		return nil, err
+	}
+	return &nsqPublisher{p: p}, nil
+}
+
+func (p *nsqPublisher) Publish(topic string, body []byte) error {
+	return p.p.Publish(topic, body)
+}
+
+func (p *nsqPublisher) Close() error {
+	p.p.Stop()
+	return nil
+}
+
+// nsqConsumer consumes a topic through a channel named after the group,
+// finding the nsqd nodes holding it through nsqlookupd.
+type nsqConsumer struct {
+	lookupd string
+}
+
+func (c nsqConsumer) Consume(ctx context.Context, topic, group string, h Handler) error {
+	q, err := nsq.NewConsumer(topic, group, nsq.NewConfig())
+	if err != nil {
+		return err
+	}
+	q.AddHandler(nsq.HandlerFunc(func(m *nsq.Message) error {
+		// nsq requeues the messages whose handler fails
+		return h(m.Body)
+	}))
+	if err := q.ConnectToNSQLookupd(c.lookupd); err != nil {
+		q.Stop()
+		return err
+	}
+	<-ctx.Done()
+	q.Stop()
+	<-q.StopChan
+	return nil
+}
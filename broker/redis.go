@@ -0,0 +1,151 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Each topic is a stream, and each group a consumer group of the stream.
+// Messages stay pending in their group until handled, and are claimed
+// again once they have been pending for redisClaimIdle.
+
+const (
+	// redisMaxLen is about how many messages a stream keeps, handled or
+	// not, before the oldest are trimmed.
+	redisMaxLen = 1_000_000
+	// redisBlock is how long a read waits for new messages.
+	redisBlock = 5 * time.Second
+	// redisClaimIdle is how long a message stays pending before it is
+	// delivered again, whether its handler failed or its consumer died.
+	redisClaimIdle = 1 * time.Minute
+	// redisBatch is how many messages are read at a time.
+	redisBatch = 100
+)
+
+// newRedisClient connects to a redis:// URL or a host:port address.
+func newRedisClient(addr string) (*redis.Client, error) {
+	if strings.Contains(addr, "://") {
+		opts, err := redis.ParseURL(addr)
+		if err != nil {
+			return nil, err
+		}
+		return redis.NewClient(opts), nil
+	}
+	return redis.NewClient(&redis.Options{Addr: addr}), nil
+}
+
+type redisPublisher struct {
+	rdb *redis.Client
+}
+
+func newRedisPublisher(addr string) (*redisPublisher, error) {
+	rdb, err := newRedisClient(addr)
+	if err != nil {
+		return nil, err
+	}
+	return &redisPublisher{rdb: rdb}, nil
+}
+
+func (p *redisPublisher) Publish(topic string, body []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), publishTimeout)
+	defer cancel()
+	return p.rdb.XAdd(ctx, &redis.XAddArgs{
+		Stream: topic,
+		MaxLen: redisMaxLen,
+		Approx: true,
+		Values: map[string]any{"body": body},
+	}).Err()
+}
+
+func (p *redisPublisher) Close() error {
+	return p.rdb.Close()
+}
+
+type redisConsumer struct {
+	rdb  *redis.Client
+	name string
+}
+
+func newRedisConsumer(addr string) (*redisConsumer, error) {
+	rdb, err := newRedisClient(addr)
+	if err != nil {
+		return nil, err
+	}
+	host, _ := os.Hostname()
+	return &redisConsumer{rdb: rdb, name: fmt.Sprintf("%s-%d", host, os.Getpid())}, nil
+}
+
+func (c *redisConsumer) Consume(ctx context.Context, topic, group string, h Handler) error {
+	defer c.rdb.Close()
+	err := c.rdb.XGroupCreateMkStream(ctx, topic, group, "0").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return err
+	}
+	handle := func(msgs []redis.XMessage) {
+		var done []string
+		for _, m := range msgs {
+			body, _ := m.Values["body"].(string)
+			if err := h([]byte(body)); err != nil {
+				// left pending to be claimed again
+				continue
+			}
+			done = append(done, m.ID)
+		}
+		if len(done) == 0 {
+			return
+		}
+		// handled messages are acked even when stopping, so that they are
+		// not handled again by the next consumer
+		ackCtx, cancel := context.WithTimeout(context.Background(), ackTimeout)
+		defer cancel()
+		if err := c.rdb.XAck(ackCtx, topic, group, done...).Err(); err != nil {
+			log.Printf("broker: failed to ack %d messages of %s: %v", len(done), topic, err)
+		}
+	}
+	var lastClaim time.Time
+	for ctx.Err() == nil {
+		if time.Since(lastClaim) > redisBlock {
+			lastClaim = time.Now()
+			msgs, _, err := c.rdb.XAutoClaim(ctx, &redis.XAutoClaimArgs{
+				Stream:   topic,
+				Group:    group,
+				Consumer: c.name,
+				MinIdle:  redisClaimIdle,
+				Start:    "0-0",
+				Count:    redisBatch,
+			}).Result()
+			if err == nil {
+				handle(msgs)
+			}
+		}
+		streams, err := c.rdb.XReadGroup(ctx, &redis.XReadGroupArgs{
+			Group:    group,
+			Consumer: c.name,
+			Streams:  []string{topic, ">"},
+			Count:    redisBatch,
+			Block:    redisBlock,
+		}).Result()
+		if errors.Is(err, redis.Nil) || ctx.Err() != nil {
+			continue
+		}
+		if err != nil {
+			log.Printf("broker: failed to read %s, retrying in %v: %v", topic, redeliverDelay, err)
+			select {
+			case <-ctx.Done():
+			case <-time.After(redeliverDelay):
+			}
+			continue
+		}
+		for _, s := range streams {
+			handle(s.Messages)
+		}
+	}
+	return nil
+}
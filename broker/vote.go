@@ -0,0 +1,74 @@
+package broker
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// VoteVersion is the version of the vote envelope. Bump it whenever the
+// envelope changes in a way the counter needs to know about. Version 2
+// added ballots and weights.
+const VoteVersion = 2
+
+// Vote is the envelope published to the "votes" topic for every vote, by
+// chatvotes for every option, or ballot of options, matched in a message
+// and by the api for votes cast through it. The counter records the votes
+// it counts in the votes collection as they are.
+type Vote struct {
+	Version int    `bson:"v" json:"v"`
+	PollID  string `bson:"poll_id,omitempty" json:"poll_id,omitempty"`
+	Option  string `bson:"option" json:"option"`
+	// Options is the ballot of approval and ranked-choice polls, the
+	// approved options or the options in order of preference. Option is
+	// always its first option.
+	Options []string `bson:"options,omitempty" json:"options,omitempty"`
+	Weight  int      `bson:"weight,omitempty" json:"weight,omitempty"`
+	// Flags mark votes for review, such as negated votes
+	Flags     []string  `bson:"flags,omitempty" json:"flags,omitempty"`
+	Source    string    `bson:"source" json:"source"`
+	AuthorID  string    `bson:"author_id,omitempty" json:"author_id,omitempty"`
+	MessageID string    `bson:"message_id,omitempty" json:"message_id,omitempty"`
+	Timestamp time.Time `bson:"timestamp" json:"timestamp"`
+}
+
+// Encode encodes the vote as a message body.
+func (v Vote) Encode() ([]byte, error) {
+	return json.Marshal(v)
+}
+
+// DecodeVote decodes a message body from the "votes" topic. Bodies that
+// are not JSON objects are treated as legacy votes whose body is the bare
+// option text.
+func DecodeVote(body []byte) (Vote, error) {
+	trimmed := bytes.TrimSpace(body)
+	if len(trimmed) == 0 || trimmed[0] != '{' {
+		return Vote{Option: string(body), Timestamp: time.Now().UTC()}, nil
+	}
+	var v Vote
+	if err := json.Unmarshal(trimmed, &v); err != nil {
+		return Vote{}, fmt.Errorf("invalid vote: %w", err)
+	}
+	if v.Version > VoteVersion {
+		return Vote{}, fmt.Errorf("unsupported vote version %d", v.Version)
+	}
+	if v.Option == "" {
+		return Vote{}, fmt.Errorf("vote is missing an option")
+	}
+	return v, nil
+}
+
+// Ballot returns the options the vote is for.
+func (v Vote) Ballot() []string {
+	if len(v.Options) == 0 {
+		return []string{v.Option}
+	}
+	return v.Options
+}
+
+// CountedWeight returns the weight the vote is counted with, 1 unless it
+// is weighted.
+func (v Vote) CountedWeight() int {
+	return max(v.Weight, 1)
+}
@@ -0,0 +1,53 @@
+package broker
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestVoteRoundTrip(t *testing.T) {
+	want := Vote{
+		Version:   VoteVersion,
+		PollID:    "p1",
+		Option:    "two",
+		Options:   []string{"two", "one"},
+		Weight:    3,
+		Flags:     []string{"negated"},
+		Source:    "chat",
+		AuthorID:  "alice",
+		MessageID: "m1",
+		Timestamp: time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+	body, err := want.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := DecodeVote(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(got.Options, want.Options) || !slices.Equal(got.Flags, want.Flags) || got.Weight != want.Weight || !got.Timestamp.Equal(want.Timestamp) {
+		t.Errorf("decoded %+v, want %+v", got, want)
+	}
+}
+
+func TestDecodeVote(t *testing.T) {
+	tests := []struct {
+		body   string
+		option string
+		ok     bool
+	}{
+		{"happy", "happy", true},
+		{`{"v":1,"option":"happy"}`, "happy", true},
+		{`{"v":99,"option":"happy"}`, "", false},
+		{`{"v":2}`, "", false},
+		{`{"v":`, "", false},
+	}
+	for _, tt := range tests {
+		v, err := DecodeVote([]byte(tt.body))
+		if (err == nil) != tt.ok || v.Option != tt.option {
+			t.Errorf("DecodeVote(%q) = %q, %v", tt.body, v.Option, err)
+		}
+	}
+}
@@ -1,108 +1,160 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"net/url"
+	"os"
 	"strings"
 	"time"
 
 	"github.com/gorilla/websocket"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
-var wsConn *websocket.Conn
+var (
+	chatURL      = flag.String("chat-url", envOr("SP_CHAT__URL", "ws://localhost:8081"), "chat server URL, ws:// or wss://")
+	chatRooms    = flag.String("chat-rooms", envOr("SP_CHAT__ROOMS", "room"), "comma separated chat rooms to join, as paths on the chat server")
+	chatName     = flag.String("chat-name", envOr("SP_CHAT__NAME", "Anonymous"), "name to join the chat rooms as")
+	chatAvatar   = flag.String("chat-avatar", envOr("SP_CHAT__AVATAR", "www.gravatar.com/avatar/0bc83cb571cd1c50ba6f3e8a78ef1346"), "avatar URL to join the chat rooms with")
+	chatCookie   = flag.String("chat-cookie", os.Getenv("SP_CHAT__COOKIE"), "auth cookie value, instead of one made from -chat-name and -chat-avatar")
+	chatToken    = flag.String("chat-token", os.Getenv("SP_CHAT__TOKEN"), "bearer token to authenticate to the chat server with")
+	chatCA       = flag.String("chat-ca", os.Getenv("SP_CHAT__CA"), "PEM file of CA certificates to trust for wss://")
+	chatInsecure = flag.Bool("chat-insecure", os.Getenv("SP_CHAT__INSECURE") == "true", "skip verifying the chat server's certificate")
+)
 
-func closeWSConn() {
-	if wsConn != nil {
-		wsConn.Close()
-	}
+type chatMessage struct {
+	Name    string
+	Message string
+	When    time.Time
 }
 
-type message struct {
-	Message string
+// chatSource reads votes from rooms of the chat server over websocket.
+// Votes are attributed to their sender whatever the room, and carry the
+// room in their message ID.
+type chatSource struct {
+	rooms  map[string]string // URL by room
+	header http.Header
+	dialer *websocket.Dialer
 }
 
-// readFromChat connects to the chat server via websocket and reads messages.
-// It looks for votes in the messages and sends them to the votes channel.
-func readFromChat(votes chan<- string) {
-	options, err := loadOptions()
+func newChatSource() (VoteSource, error) {
+	base, err := url.Parse(*chatURL)
 	if err != nil {
-		log.Fatalln("failed to load options:", err)
-		return
+		return nil, err
 	}
-
-	u := url.URL{Scheme: "ws", Host: "localhost:8080", Path: "/room"}
-	log.Println("connecting to", u.String())
-
-	// create websocket header with authentication if needed
-	authData := map[string]any{
-		"name":       "Anonymous",
-		"avatar_url": "www.gravatar.com/avatar/0bc83cb571cd1c50ba6f3e8a78ef1346",
+	switch base.Scheme {
+	case "ws", "wss":
+	case "http":
+		base.Scheme = "ws"
+	case "https":
+		base.Scheme = "wss"
+	default:
+		return nil, fmt.Errorf("chat URL %q must be ws:// or wss://", *chatURL)
 	}
-	jsonBytes, err := json.Marshal(authData)
-	if err != nil {
-		log.Println("failed to marshal auth data:", err)
-		return
+	rooms := make(map[string]string)
+	for room := range strings.SplitSeq(*chatRooms, ",") {
+		room = strings.Trim(strings.TrimSpace(room), "/")
+		if room != "" {
+			rooms[room] = base.JoinPath(room).String()
+		}
+	}
+	if len(rooms) == 0 {
+		return nil, errors.New("no chat rooms to join")
 	}
-	authCookieValue := base64.StdEncoding.EncodeToString(jsonBytes)
 
+	cookie := *chatCookie
+	if cookie == "" {
+		// the chat server trusts the identity in its auth cookie
+		authData := map[string]any{
+			"name":       *chatName,
+			"avatar_url": *chatAvatar,
+		}
+		jsonBytes, err := json.Marshal(authData)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal auth data: %w", err)
+		}
+		cookie = base64.StdEncoding.EncodeToString(jsonBytes)
+	}
 	header := make(http.Header)
-	header["cookie"] = []string{fmt.Sprintf("auth=%s", authCookieValue)}
-
-	ws, _, err := websocket.DefaultDialer.Dial(u.String(), header)
-	if err != nil {
-		log.Println("dial failed:", err)
-		return
+	header.Set("Cookie", fmt.Sprintf("auth=%s", cookie))
+	if *chatToken != "" {
+		header.Set("Authorization", "Bearer "+*chatToken)
 	}
-	defer ws.Close()
-	wsConn = ws
-	log.Println("connected to", u.String())
 
-	for {
-		var msg message
-		if err := ws.ReadJSON(&msg); err != nil {
-			log.Println("error reading message:", err)
-			break
+	tlsConfig := &tls.Config{InsecureSkipVerify: *chatInsecure}
+	if *chatCA != "" {
+		pem, err := os.ReadFile(*chatCA)
+		if err != nil {
+			return nil, err
 		}
-		for _, option := range options {
-			if strings.Contains(
-				strings.ToLower(msg.Message),
-				strings.ToLower(option),
-			) {
-				log.Println("vote:", option)
-				// send the vote to the votes channel
-				votes <- option
-			}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", *chatCA)
 		}
 	}
+	dialer := *websocket.DefaultDialer
+	dialer.TLSClientConfig = tlsConfig
+	return &chatSource{rooms: rooms, header: header, dialer: &dialer}, nil
 }
 
-func startChatStream(stopchan <-chan struct{}, votes chan<- string) <-chan struct{} {
-	// stoppedchan is closed when the chat reading goroutine stops.
-	// 1 buffer to ensure no blocking on stop.
-	stoppedchan := make(chan struct{}, 1)
-	go func() {
-		defer func() {
-			stoppedchan <- struct{}{}
+func (*chatSource) Name() string { return sourceChat }
+
+// Run joins every room and emits the messages posted to them. The first
+// room to disconnect ends the connection to all of them, so that the
+// supervisor rejoins them together.
+func (c *chatSource) Run(ctx context.Context, emit func(message)) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	errs := make(chan error, len(c.rooms))
+	for room, u := range c.rooms {
+		go func() {
+			errs <- c.readRoom(ctx, room, u, emit)
 		}()
-		for {
-			select {
-			// Check if we need to stop
-			case <-stopchan:
-				log.Println("stopping chat...")
-				closeWSConn()
-				return
-			// Default case to run the chat reading
-			default:
-				log.Println("Connecting to chat...")
-				readFromChat(votes)
-				log.Println("Reconnecting to chat in 10 seconds...")
-				time.Sleep(10 * time.Second) // wait before reconnecting
-			}
+	}
+	err := <-errs
+	cancel()
+	for range len(c.rooms) - 1 {
+		<-errs
+	}
+	return err
+}
+
+// readRoom connects to a room and emits the messages posted to it.
+func (c *chatSource) readRoom(ctx context.Context, room, u string, emit func(message)) error {
+	log.Println("connecting to", u)
+	ws, _, err := c.dialer.DialContext(ctx, u, c.header)
+	if err != nil {
+		return fmt.Errorf("dial %s failed: %w", u, err)
+	}
+	defer ws.Close()
+	log.Println("connected to", u)
+
+	// unblock the read below when stopping
+	stop := context.AfterFunc(ctx, func() { ws.Close() })
+	defer stop()
+
+	for {
+		var msg chatMessage
+		if err := ws.ReadJSON(&msg); err != nil {
+			return fmt.Errorf("error reading message from %s: %w", room, err)
 		}
-	}()
-	return stoppedchan
+		// the sender is the same voter in every room, so the room only
+		// goes into the message ID, and the chat server gives messages no
+		// ID of their own
+		emit(message{
+			Text:      msg.Message,
+			AuthorID:  msg.Name,
+			MessageID: room + ":" + primitive.NewObjectID().Hex(),
+			When:      msg.When,
+		})
+	}
 }
@@ -3,15 +3,35 @@ module github.com/liyu-wang/go-socialpoll/chatvotes
 go 1.25.3
 
 require (
-	github.com/globalsign/mgo v0.0.0-20181015135952-eeefdecb41b8
-	github.com/gomodule/oauth1 v0.2.0
 	github.com/gorilla/websocket v1.5.3
 	github.com/joeshaw/envdecode v0.0.0-20200121155833-099f1fc765bd
-	github.com/nsqio/go-nsq v1.1.0
+	github.com/liyu-wang/go-socialpoll/broker v0.0.0
+	github.com/liyu-wang/go-socialpoll/counter v0.0.0
+	go.mongodb.org/mongo-driver v1.17.6
 )
 
 require (
+	github.com/cespare/xxhash/v2 v2.3.0 // indirect
+	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
 	github.com/golang/snappy v1.0.0 // indirect
-	go.mongodb.org/mongo-driver v1.17.6 // indirect
-	gopkg.in/check.v1 v1.0.0-20201130134442-10cb98267c6c // indirect
+	github.com/klauspost/compress v1.18.0 // indirect
+	github.com/montanaflynn/stats v0.7.1 // indirect
+	github.com/nats-io/nats.go v1.48.0 // indirect
+	github.com/nats-io/nkeys v0.4.11 // indirect
+	github.com/nats-io/nuid v1.0.1 // indirect
+	github.com/nsqio/go-nsq v1.1.0 // indirect
+	github.com/redis/go-redis/v9 v9.17.2 // indirect
+	github.com/xdg-go/pbkdf2 v1.0.0 // indirect
+	github.com/xdg-go/scram v1.1.2 // indirect
+	github.com/xdg-go/stringprep v1.0.4 // indirect
+	github.com/youmark/pkcs8 v0.0.0-20240726163527-a2c0da244d78 // indirect
+	golang.org/x/crypto v0.37.0 // indirect
+	golang.org/x/sync v0.13.0 // indirect
+	golang.org/x/sys v0.32.0 // indirect
+	golang.org/x/text v0.24.0 // indirect
+)
+
+replace (
+	github.com/liyu-wang/go-socialpoll/broker => ../broker
+	github.com/liyu-wang/go-socialpoll/counter => ../counter
 )
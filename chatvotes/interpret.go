@@ -0,0 +1,163 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+)
+
+var (
+	interpretLang   = flag.String("interpret", os.Getenv("SP_INTERPRET"), "language to interpret messages in when they do not say, such as en; empty to count every mention")
+	interpretPolicy = flag.String("interpret-policy", envOr("SP_INTERPRET__POLICY", policyDrop), "what to do with mentions spoken against: drop, invert or flag")
+)
+
+// policies for mentions spoken against
+const (
+	policyDrop   = "drop"   // the mention is not a vote, the default
+	policyInvert = "invert" // the mention is a vote for the other option of a two option poll, and dropped otherwise
+	policyFlag   = "flag"   // the mention is a vote, flagged as negated
+)
+
+// flagNegated marks votes from mentions spoken against.
+const flagNegated = "negated"
+
+// stance is how a message speaks of an option it mentions.
+type stance int
+
+const (
+	stanceFor stance = iota
+	stanceAgainst
+)
+
+func (s stance) String() string {
+	if s == stanceAgainst {
+		return "against"
+	}
+	return "for"
+}
+
+// Interpreter reads the stance of messages in one language towards the
+// options they mention.
+type Interpreter interface {
+	// Stance returns the stance of text towards the option mentioned by
+	// tokens[start:end].
+	Stance(text string, tokens []token, start, end int) stance
+}
+
+// interpreters are the interpreters by language code.
+var interpreters = map[string]Interpreter{
+	"en": englishInterpreter{},
+}
+
+// interpreterFor returns the interpreter for messages in lang, falling back
+// to the -interpret language, or nil if messages are not interpreted.
+func interpreterFor(lang string) Interpreter {
+	if *interpretLang == "" {
+		return nil
+	}
+	if in, ok := interpreters[strings.ToLower(lang)]; ok {
+		return in
+	}
+	return interpreters[*interpretLang]
+}
+
+func validateInterpretation() error {
+	if _, ok := interpreters[*interpretLang]; *interpretLang != "" && !ok {
+		return fmt.Errorf("no interpreter for language %q", *interpretLang)
+	}
+	switch *interpretPolicy {
+	case policyDrop, policyInvert, policyFlag:
+		return nil
+	}
+	return fmt.Errorf("invalid interpret policy %q", *interpretPolicy)
+}
+
+// clauseBreak reports whether text has punctuation between the tokens a and
+// b, ending the clause a is in.
+func clauseBreak(text string, a, b token) bool {
+	from, to := a.end, b.pos
+	if b.pos < a.pos {
+		from, to = b.end, a.pos
+	}
+	if from >= to || to > len(text) {
+		return false
+	}
+	return strings.ContainsAny(text[from:to], ".,;:!?()")
+}
+
+// englishInterpreter finds negations before a mentioned option, such as
+// "not happy", and negative words next to it, such as "pizza sucks",
+// within the mention's clause.
+type englishInterpreter struct{}
+
+// englishWindow is how many words around a mention are looked at.
+const englishWindow = 3
+
+var (
+	englishNegators = []string{
+		"not", "no", "never", "nobody", "nothing", "neither", "nor", "none",
+		"cannot", "hardly", "against", "anti", "without",
+	}
+	// englishNotNegations are negators followed by these words that do
+	// not negate, as in "not only" or "no doubt"
+	englishNotNegations = map[string][]string{
+		"not":   {"only", "just", "bad"},
+		"no":    {"doubt", "question", "brainer"},
+		"can't": {"wait"},
+		"never": {"mind"},
+	}
+	englishNegative = []string{
+		"sucks", "suck", "terrible", "awful", "horrible", "hate", "hates",
+		"worst", "bad", "boo", "meh", "overrated", "trash", "garbage", "ugh",
+		"👎", "🤮", "💩",
+	}
+	englishPositive = []string{
+		"love", "loves", "best", "great", "awesome", "like", "likes",
+		"yay", "go", "vote", "pick", "choose", "👍", "❤", "🔥",
+	}
+)
+
+func (englishInterpreter) Stance(text string, tokens []token, start, end int) stance {
+	// negations before the mention
+	for i := start - 1; i >= max(0, start-englishWindow); i-- {
+		if clauseBreak(text, tokens[i], tokens[i+1]) {
+			break
+		}
+		w := tokens[i].text
+		if !slices.Contains(englishNegators, w) && !strings.HasSuffix(w, "n't") {
+			continue
+		}
+		if i+1 < start && slices.Contains(englishNotNegations[w], tokens[i+1].text) {
+			continue
+		}
+		return stanceAgainst
+	}
+	// negative and positive words around it
+	var score int
+	count := func(i int) {
+		switch w := tokens[i].text; {
+		case slices.Contains(englishNegative, w):
+			score--
+		case slices.Contains(englishPositive, w):
+			score++
+		}
+	}
+	for i := start - 1; i >= max(0, start-englishWindow); i-- {
+		if clauseBreak(text, tokens[i], tokens[i+1]) {
+			break
+		}
+		count(i)
+	}
+	for i := end; i < min(len(tokens), end+englishWindow); i++ {
+		if clauseBreak(text, tokens[i-1], tokens[i]) {
+			break
+		}
+		count(i)
+	}
+	if score < 0 {
+		return stanceAgainst
+	}
+	return stanceFor
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+// TestInterpreters checks the interpreters against a corpus of tricky
+// messages. Add the messages the interpreters get wrong here before
+// fixing them.
+func TestInterpreters(t *testing.T) {
+	tests := []struct {
+		lang   string
+		text   string
+		option string
+		want   stance
+	}{
+		{"en", "happy", "happy", stanceFor},
+		{"en", "I am happy", "happy", stanceFor},
+		{"en", "I am not happy", "happy", stanceAgainst},
+		{"en", "I'm not very happy", "happy", stanceAgainst},
+		{"en", "I don't like pizza", "pizza", stanceAgainst},
+		{"en", "I love pizza", "pizza", stanceFor},
+		{"en", "pizza sucks", "pizza", stanceAgainst},
+		{"en", "pizza 👎", "pizza", stanceAgainst},
+		{"en", "pizza 👍", "pizza", stanceFor},
+		{"en", "never tacos again", "tacos", stanceAgainst},
+		{"en", "not only tacos but burritos too", "tacos", stanceFor},
+		{"en", "no doubt, tacos", "tacos", stanceFor},
+		{"en", "can't wait for tacos", "tacos", stanceFor},
+		{"en", "I'm happy, not sad", "happy", stanceFor},
+		{"en", "I'm happy, not sad", "sad", stanceAgainst},
+		{"en", "Not. Tacos!", "tacos", stanceFor},
+		{"en", "yes! not no", "yes", stanceFor},
+		{"en", "yes! not no", "no", stanceAgainst},
+		{"en", "I say no", "no", stanceFor},
+		{"en", "no to brexit", "brexit", stanceAgainst},
+		{"en", "the worst option is pizza, tacos are great", "tacos", stanceFor},
+		{"en", "pizza is the worst", "pizza", stanceAgainst},
+		{"en", "pizza, the worst? no, the best", "pizza", stanceFor},
+		{"en", "winter is not coming", "winter", stanceFor},
+	}
+	for _, tt := range tests {
+		t.Run(tt.lang+"/"+tt.text+"/"+tt.option, func(t *testing.T) {
+			tokens := tokenize(tt.text)
+			option := words(tt.option)
+			for i := range tokens {
+				if i+len(option) > len(tokens) {
+					break
+				}
+				if !slices.EqualFunc(tokens[i:i+len(option)], option, func(tok token, w string) bool { return tok.text == w }) {
+					continue
+				}
+				if got := interpreters[tt.lang].Stance(tt.text, tokens, i, i+len(option)); got != tt.want {
+					t.Errorf("%q is %v, want %v", tt.option, got, tt.want)
+				}
+				return
+			}
+			t.Errorf("%q is not mentioned", tt.option)
+		})
+	}
+}
+
+func TestClauseBreak(t *testing.T) {
+	text := "I don’t like #pizza, #tacos rock"
+	tokens := tokenize(text)
+	var got []string
+	for _, tok := range tokens {
+		got = append(got, text[tok.pos:tok.end])
+	}
+	want := []string{"I", "don’t", "like", "#pizza", "#tacos", "rock"}
+	if !slices.Equal(got, want) {
+		t.Fatalf("tokens span %q, want %q", got, want)
+	}
+	tests := []struct {
+		a, b int
+		want bool
+	}{
+		{1, 2, false}, // after the curly apostrophe
+		{2, 3, false}, // before the hashtag
+		{3, 4, true},  // after the hashtag
+		{4, 3, true},
+		{4, 5, false},
+	}
+	for _, tt := range tests {
+		if got := clauseBreak(text, tokens[tt.a], tokens[tt.b]); got != tt.want {
+			t.Errorf("clauseBreak(%q, %q) = %v, want %v", tokens[tt.a].text, tokens[tt.b].text, got, tt.want)
+		}
+	}
+}
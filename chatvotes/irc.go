@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/joeshaw/envdecode"
+)
+
+// ircIdleTimeout is how long the server may stay silent. Servers ping
+// their clients well within this, so a silent connection is dead.
+const ircIdleTimeout = 5 * time.Minute
+
+// ircMaxNickRetries is how many alternative nicks are tried when the
+// configured one is taken.
+const ircMaxNickRetries = 5
+
+// ircSource reads votes from the messages sent to IRC channels. Voters are
+// identified by their nick!user@host.
+type ircSource struct {
+	server       string
+	tls          bool
+	nick         string
+	channels     []string
+	saslUser     string
+	saslPassword string
+}
+
+func newIRCSource() (VoteSource, error) {
+	var is struct {
+		Server       string `env:"SP_IRC__SERVER,required"` // host:port
+		TLS          bool   `env:"SP_IRC__TLS,default=false"`
+		Nick         string `env:"SP_IRC__NICK,default=socialpoll"`
+		Channels     string `env:"SP_IRC__CHANNELS,required"` // comma separated
+		SASLUser     string `env:"SP_IRC__SASLUSER"`
+		SASLPassword string `env:"SP_IRC__SASLPASSWORD"`
+	}
+	if err := envdecode.Decode(&is); err != nil {
+		return nil, err
+	}
+	var channels []string
+	for channel := range strings.SplitSeq(is.Channels, ",") {
+		if channel = strings.TrimSpace(channel); channel != "" {
+			channels = append(channels, channel)
+		}
+	}
+	if len(channels) == 0 {
+		return nil, errors.New("no channels in SP_IRC__CHANNELS")
+	}
+	return &ircSource{
+		server:       is.Server,
+		tls:          is.TLS,
+		nick:         is.Nick,
+		channels:     channels,
+		saslUser:     is.SASLUser,
+		saslPassword: is.SASLPassword,
+	}, nil
+}
+
+func (*ircSource) Name() string { return sourceIRC }
+
+// ircMessage is a line received from an IRC server.
+type ircMessage struct {
+	Prefix  string // nick!user@host of users, or the server name
+	Command string
+	Params  []string
+}
+
+// parseIRC parses a line, ignoring any message tags.
+func parseIRC(line string) ircMessage {
+	var m ircMessage
+	if strings.HasPrefix(line, "@") {
+		_, line, _ = strings.Cut(line, " ")
+	}
+	if strings.HasPrefix(line, ":") {
+		m.Prefix, line, _ = strings.Cut(line[1:], " ")
+	}
+	line, trailing, hasTrailing := strings.Cut(line, " :")
+	fields := strings.Fields(line)
+	if len(fields) > 0 {
+		m.Command = strings.ToUpper(fields[0])
+		m.Params = fields[1:]
+	}
+	if hasTrailing {
+		m.Params = append(m.Params, trailing)
+	}
+	return m
+}
+
+// param returns the i-th parameter, or "" if there is none.
+func (m ircMessage) param(i int) string {
+	if i >= 0 && i < len(m.Params) {
+		return m.Params[i]
+	}
+	return ""
+}
+
+// Run connects to the server, registers, joins the channels and emits the
+// messages sent to them.
+func (s *ircSource) Run(ctx context.Context, emit func(message)) error {
+	var conn net.Conn
+	var err error
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	if s.tls {
+		tlsDialer := &tls.Dialer{NetDialer: dialer}
+		conn, err = tlsDialer.DialContext(ctx, "tcp", s.server)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", s.server)
+	}
+	if err != nil {
+		return fmt.Errorf("dial failed: %w", err)
+	}
+	defer conn.Close()
+	// unblock the read below when stopping
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+	log.Println("connected to irc", s.server)
+
+	send := func(format string, args ...any) error {
+		conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+		_, err := fmt.Fprintf(conn, format+"\r\n", args...)
+		return err
+	}
+	nick := s.nick
+	sasl := s.saslUser != ""
+	if sasl {
+		if err := send("CAP REQ :sasl"); err != nil {
+			return err
+		}
+	}
+	if err := send("NICK %s", nick); err != nil {
+		return err
+	}
+	if err := send("USER %s 0 * :socialpoll", s.nick); err != nil {
+		return err
+	}
+
+	retries := 0
+	scanner := bufio.NewScanner(conn)
+	for {
+		conn.SetReadDeadline(time.Now().Add(ircIdleTimeout))
+		if !scanner.Scan() {
+			if err := scanner.Err(); err != nil {
+				return fmt.Errorf("error reading from irc: %w", err)
+			}
+			return errors.New("irc server closed the connection")
+		}
+		m := parseIRC(scanner.Text())
+		switch m.Command {
+		case "PING":
+			err = send("PONG :%s", m.param(0))
+
+		case "CAP":
+			switch {
+			case !sasl:
+			case m.param(1) == "ACK":
+				err = send("AUTHENTICATE PLAIN")
+			case m.param(1) == "NAK":
+				return errors.New("irc server does not support SASL")
+			}
+
+		case "AUTHENTICATE":
+			if m.param(0) == "+" {
+				creds := s.saslUser + "\x00" + s.saslUser + "\x00" + s.saslPassword
+				err = send("AUTHENTICATE %s", base64.StdEncoding.EncodeToString([]byte(creds)))
+			}
+
+		case "903": // RPL_SASLSUCCESS
+			err = send("CAP END")
+
+		case "902", "904", "905", "906": // SASL failed
+			return fmt.Errorf("SASL authentication failed: %s", m.param(len(m.Params)-1))
+
+		case "432", "433", "436": // nick erroneous, in use or colliding
+			retries++
+			if retries > ircMaxNickRetries {
+				return fmt.Errorf("nick %s is not available", s.nick)
+			}
+			nick += "_"
+			log.Printf("irc nick %s is taken, trying %s", m.param(1), nick)
+			err = send("NICK %s", nick)
+
+		case "001": // RPL_WELCOME
+			log.Println("registered with irc as", m.param(0))
+			err = send("JOIN %s", strings.Join(s.channels, ","))
+
+		case "ERROR":
+			return fmt.Errorf("irc error: %s", m.param(0))
+
+		case "PRIVMSG":
+			target, text := m.param(0), m.param(1)
+			if target == "" || !strings.ContainsRune("#&+!", rune(target[0])) {
+				// private messages are not votes
+				continue
+			}
+			if strings.HasPrefix(text, "\x01") {
+				// only CTCP ACTION (/me) carries text
+				action, ok := strings.CutPrefix(strings.Trim(text, "\x01"), "ACTION ")
+				if !ok {
+					continue
+				}
+				text = action
+			}
+			emit(message{Text: text, AuthorID: m.Prefix, When: time.Now()})
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,20 @@
+package main
+
+import "testing"
+
+func TestIRCLastParam(t *testing.T) {
+	tests := []struct {
+		line string
+		want string
+	}{
+		{":server 904 nick :SASL authentication failed", "SASL authentication failed"},
+		{":server 904", ""},
+		{"PING", ""},
+	}
+	for _, tt := range tests {
+		m := parseIRC(tt.line)
+		if got := m.param(len(m.Params) - 1); got != tt.want {
+			t.Errorf("last param of %q = %q, want %q", tt.line, got, tt.want)
+		}
+	}
+}
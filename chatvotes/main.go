@@ -2,66 +2,112 @@ package main
 
 import (
 	"context"
+	"expvar"
+	"flag"
 	"log"
+	"net/http"
 	"os"
 	"os/signal"
-	"sync/atomic"
+	"sync"
 	"syscall"
 	"time"
 
-	"github.com/nsqio/go-nsq"
-	"go.mongodb.org/mongo-driver/bson"
+	"github.com/liyu-wang/go-socialpoll/broker"
+	"github.com/liyu-wang/go-socialpoll/counter/count"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 func main() {
 	// Entry point for the chatvotes application
-	var stopFlag atomic.Bool
-	stopchan := make(chan struct{}, 1)
-	signalChan := make(chan os.Signal, 1)
-
-	// goroutine to handle interrupt signal
-	go func() {
-		// wait for an interrupt signal such as control+C
-		<-signalChan
-		stopFlag.Store(true)
-		log.Println("Stopping...")
-		stopchan <- struct{}{}
-		closeWSConn()
-	}()
+	sourceNames := flag.String("sources", envOr("SP_SOURCES", sourceChat), "comma separated vote sources to run: chat, twitter, mastodon, irc, webhook")
+	outboxDir := flag.String("outbox", envOr("SP_OUTBOX", "outbox"), "directory of the outbox holding votes that failed to publish")
+	outboxMax := flag.Int64("outbox-max-mb", 100, "most disk space the outbox may use, in MB")
+	statusAddr := flag.String("status-addr", os.Getenv("SP_STATUS_ADDR"), "address to serve counters, such as the outbox depth, at /debug/vars; empty to disable")
+	brokerConfig := broker.Flags(flag.CommandLine)
+	countPolicy := flag.String("policy", count.DefaultPolicy, "voting policy for polls without one, when counting votes in-process with -broker inproc")
+	flag.Parse()
+	if err := validateInterpretation(); err != nil {
+		log.Fatalln(err)
+	}
+	sources, err := newSources(*sourceNames)
+	if err != nil {
+		log.Fatalln(err)
+	}
 
-	// send the interrupt signal to signalChan
-	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
+	// stop on an interrupt signal such as control+C
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
 
 	// connect to the database
 	if err := dialdb(); err != nil {
+		if brokerConfig.Kind == broker.KindInproc {
+			log.Fatalln("failed to dial mongodb, which counting votes in-process needs:", err)
+		}
 		log.Println("warning: failed to dial mongodb:", err)
 		log.Println("continuing without database...")
 	}
 	defer closedb()
 
-	// start things
-	votes := make(chan string)
-	publisherStoppedChan := publishVotes(votes)
-	chatStoppedChan := startChatStream(stopchan, votes)
+	// load the open polls, and keep them up to date
+	reloadPolls()
+	go watchPolls(ctx)
 
-	// periodic closer to force reconnects
-	go func() {
-		for {
-			time.Sleep(1 * time.Minute)
-			log.Println("periodic closer: closing websocket connection to force reconnect")
-			closeWSConn()
-			log.Println("periodic closer: done closing websocket connection")
-			if stopFlag.Load() {
-				return
+	box, err := openOutbox(*outboxDir, *outboxMax<<20)
+	if err != nil {
+		log.Fatalln("failed to open outbox:", err)
+	}
+	expvar.Publish("outbox_depth", expvar.Func(func() any { return box.len() }))
+	if *statusAddr != "" {
+		go func() {
+			log.Println("serving status on", *statusAddr)
+			if err := http.ListenAndServe(*statusAddr, nil); err != nil {
+				log.Println("status server failed:", err)
 			}
+		}()
+	}
+
+	pub, err := broker.NewPublisher(*brokerConfig)
+	if err != nil {
+		log.Fatalf("failed to connect to %s: %v", brokerConfig.Kind, err)
+	}
+
+	// in-process votes can only be counted by this process, which makes
+	// chatvotes the whole pipeline
+	counterCtx, stopCounter := context.WithCancel(context.Background())
+	counterStoppedChan := make(chan struct{})
+	if brokerConfig.Kind == broker.KindInproc {
+		consumer, err := broker.NewConsumer(*brokerConfig)
+		if err != nil {
+			log.Fatalln("failed to consume in-process votes:", err)
 		}
-	}()
+		go func() {
+			defer close(counterStoppedChan)
+			if err := count.Run(counterCtx, dbClient, consumer, *countPolicy); err != nil {
+				log.Fatalln("counter failed:", err)
+			}
+		}()
+	} else {
+		close(counterStoppedChan)
+	}
 
-	<-chatStoppedChan
+	// start things
+	votes := make(chan vote)
+	publisherStoppedChan := publishVotes(votes, pub, box)
+	var sourcesWG sync.WaitGroup
+	for _, src := range sources {
+		sourcesWG.Go(func() { supervise(ctx, src, votes) })
+	}
+
+	<-ctx.Done()
+	log.Println("Stopping...")
+	sourcesWG.Wait()
 	close(votes)
 	<-publisherStoppedChan
+	// the counter flushes the votes it received as it stops
+	stopCounter()
+	<-counterStoppedChan
 	log.Println("Stopped.")
 }
 
@@ -123,14 +169,33 @@ func closedb() {
 	}
 }
 
+// poll types, see the counter
+const (
+	typeApproval = "approval"
+	typeRanked   = "ranked"
+)
+
 type poll struct {
-	Options []string `bson:"options"`
+	ID       primitive.ObjectID `bson:"_id"`
+	Type     string             `bson:"type"`
+	Hashtag  string             `bson:"hashtag"`
+	Options  []string           `bson:"options"`
+	OpensAt  *time.Time         `bson:"opens_at"`
+	ClosesAt *time.Time         `bson:"closes_at"`
+	Match    *matchRules        `bson:"match"`
+}
+
+// isOpen reports whether the poll accepts votes at the given time.
+func (p poll) isOpen(now time.Time) bool {
+	if p.OpensAt != nil && now.Before(*p.OpensAt) {
+		return false
+	}
+	return p.ClosesAt == nil || now.Before(*p.ClosesAt)
 }
 
-func loadOptions() ([]string, error) {
+func loadOptions() ([]poll, error) {
 	if dbClient == nil {
-		log.Println("warning: database not connected, returning empty options")
-		return []string{}, nil
+		return nil, nil
 	}
 
 	// Create a dedicated timeout context for this operation
@@ -140,47 +205,129 @@ func loadOptions() ([]string, error) {
 
 	collection := dbClient.Database("ballots").Collection("polls")
 
-	// Use empty bson.M{} instead of nil for clarity
-	cursor, err := collection.Find(ctx, bson.M{})
+	// Only load polls that are open for voting
+	cursor, err := collection.Find(ctx, count.OpenPollsFilter(time.Now()))
 	if err != nil {
-		log.Println("error finding polls:", err)
-		return []string{}, nil
+		return nil, err
 	}
 	defer cursor.Close(ctx)
 
 	// Use cursor.All() for cleaner code
 	var polls []poll
 	if err = cursor.All(ctx, &polls); err != nil {
-		log.Println("error decoding polls:", err)
-		return []string{}, nil
+		return nil, err
 	}
 
-	var options []string
-	for _, p := range polls {
-		options = append(options, p.Options...)
-	}
+	return polls, nil
+}
 
-	if len(options) == 0 {
-		log.Println("no poll options found in database")
-	} else {
-		log.Printf("loaded %d poll options\n", len(options))
-	}
+const (
+	// outboxMinBackoff and outboxMaxBackoff bound how long the publisher
+	// waits before retrying the votes in the outbox.
+	outboxMinBackoff = 1 * time.Second
+	outboxMaxBackoff = 1 * time.Minute
+	// outboxBatch is how many votes are published from the outbox before
+	// new votes are taken again.
+	outboxBatch = 500
+)
 
-	return options, nil
-}
+var (
+	votesPublished = expvar.NewInt("votes_published")
+	votesQueued    = expvar.NewInt("votes_queued")
+	votesDropped   = expvar.NewInt("votes_dropped")
+)
 
-func publishVotes(votes <-chan string) <-chan struct{} {
+// publishVotes publishes the votes to the "votes" topic. Votes that fail
+// to publish are queued in the outbox and retried with exponential
+// backoff, and while the outbox holds votes new votes queue behind them,
+// so votes are published in order. Votes are dropped only when the outbox
+// is full.
+func publishVotes(votes <-chan vote, pub broker.Publisher, box *outbox) <-chan struct{} {
 	stopchan := make(chan struct{}, 1)
-	pub, _ := nsq.NewProducer("localhost:4150", nsq.NewConfig())
+	publish := func(body []byte) error {
+		return pub.Publish("votes", body)
+	}
 	go func() {
-		for vote := range votes {
-			pub.Publish("votes", []byte(vote)) // publish vote to NSQ
-			log.Println("Published vote:", vote)
+		backoff := outboxMinBackoff
+		var retry <-chan time.Time
+		if box.len() > 0 {
+			log.Printf("Publisher: %d votes in the outbox", box.len())
+			retry = time.After(0)
+		}
+		for {
+			select {
+			case v, ok := <-votes:
+				if !ok {
+					log.Println("Publisher: stopping")
+					pub.Close()
+					if n := box.len(); n > 0 {
+						log.Printf("Publisher: %d votes left in the outbox", n)
+					}
+					box.close()
+					log.Println("Publisher: stopped")
+					stopchan <- struct{}{}
+					return
+				}
+				body, err := v.Encode()
+				if err != nil {
+					log.Println("failed to encode vote:", err)
+					continue
+				}
+				if box.len() == 0 {
+					err := publish(body)
+					if err == nil {
+						votesPublished.Add(1)
+						log.Println("Published vote:", v.Option)
+						continue
+					}
+					log.Println("failed to publish vote, queueing it in the outbox:", err)
+				}
+				if err := box.append(body); err != nil {
+					votesDropped.Add(1)
+					log.Println("dropping vote:", err)
+					continue
+				}
+				votesQueued.Add(1)
+				if retry == nil {
+					retry = time.After(backoff)
+				}
+			case <-retry:
+				retry = nil
+				n, err := drainOutbox(box, publish)
+				votesPublished.Add(int64(n))
+				switch {
+				case err != nil:
+					backoff = min(backoff*2, outboxMaxBackoff)
+					retry = time.After(backoff)
+					log.Printf("failed to publish from the outbox, %d votes waiting, retrying in %v: %v", box.len(), backoff, err)
+				case box.len() > 0:
+					backoff = outboxMinBackoff
+					retry = time.After(0)
+				default:
+					backoff = outboxMinBackoff
+					log.Printf("published %d votes from the outbox, which is now empty", n)
+				}
+			}
 		}
-		log.Println("Publisher: stopping")
-		pub.Stop()
-		log.Println("Publisher: stopped")
-		stopchan <- struct{}{}
 	}()
 	return stopchan
 }
+
+// drainOutbox publishes up to outboxBatch votes from the outbox, oldest
+// first, stopping at the first that fails. It returns how many it
+// published.
+func drainOutbox(box *outbox, publish func([]byte) error) (int, error) {
+	for n := 0; n < outboxBatch; n++ {
+		body, err := box.peek()
+		if err != nil || body == nil {
+			return n, err
+		}
+		if err := publish(body); err != nil {
+			return n, err
+		}
+		if err := box.commit(); err != nil {
+			return n + 1, err
+		}
+	}
+	return outboxBatch, nil
+}
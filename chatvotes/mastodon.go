@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/joeshaw/envdecode"
+)
+
+// mastodonSource reads votes from the streaming API of a Mastodon
+// instance: the hashtag timeline of every poll with a hashtag, and the
+// public timeline if any poll has none.
+type mastodonSource struct {
+	instance string
+	token    string
+	local    bool
+	client   *http.Client
+}
+
+func newMastodonSource() (VoteSource, error) {
+	var ms struct {
+		URL   string `env:"SP_MASTODON__URL,required"`
+		Token string `env:"SP_MASTODON__TOKEN,required"`
+		Local bool   `env:"SP_MASTODON__LOCAL,default=false"`
+	}
+	if err := envdecode.Decode(&ms); err != nil {
+		return nil, err
+	}
+	return &mastodonSource{
+		instance: strings.TrimSuffix(ms.URL, "/"),
+		token:    ms.Token,
+		local:    ms.Local,
+		// no timeout, the streams stay open
+		client: &http.Client{},
+	}, nil
+}
+
+func (*mastodonSource) Name() string { return sourceMastodon }
+
+// mastodonStatus is a status as delivered by the streaming API.
+type mastodonStatus struct {
+	ID        string    `json:"id"`
+	Content   string    `json:"content"` // HTML
+	CreatedAt time.Time `json:"created_at"`
+	Language  string    `json:"language"`
+	Account   struct {
+		ID   string `json:"id"`
+		Acct string `json:"acct"`
+	} `json:"account"`
+	// Reblog is set for boosts, which are not votes of their own
+	Reblog *json.RawMessage `json:"reblog"`
+}
+
+// Run opens the timelines the open polls need and emits the statuses
+// posted to them. A status posted to several of them is emitted once.
+// Timelines are opened and closed as the open polls change.
+func (m *mastodonSource) Run(ctx context.Context, emit func(message)) error {
+	ctx, cancel := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+	seen := newSeenStatuses()
+	handle := func(s mastodonStatus) {
+		if s.Reblog != nil || !seen.add(s.ID) {
+			return
+		}
+		emit(message{
+			Text:      stripHTML(s.Content),
+			AuthorID:  s.Account.ID,
+			MessageID: s.ID,
+			When:      s.CreatedAt,
+			Lang:      s.Language,
+		})
+	}
+
+	errs := make(chan error, 1)
+	streams := make(map[string]context.CancelFunc)
+	polls := currentPolls()
+	for {
+		want := mastodonStreams(polls.polls, m.local)
+		for path, stop := range streams {
+			if !slices.Contains(want, path) {
+				log.Println("closing mastodon", path)
+				stop()
+				delete(streams, path)
+			}
+		}
+		for _, path := range want {
+			if _, ok := streams[path]; ok {
+				continue
+			}
+			streamCtx, stop := context.WithCancel(ctx)
+			streams[path] = stop
+			wg.Go(func() {
+				err := m.stream(streamCtx, path, handle)
+				if streamCtx.Err() == nil {
+					// the first stream to end on its own ends the
+					// connection, so the supervisor reconnects them all
+					select {
+					case errs <- err:
+					default:
+					}
+				}
+			})
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-errs:
+			return err
+		case <-polls.changed:
+			polls = currentPolls()
+		}
+	}
+}
+
+// mastodonStreams returns the streaming API paths the polls need.
+func mastodonStreams(polls []poll, local bool) []string {
+	var streams []string
+	public := false
+	for _, p := range polls {
+		if p.Hashtag == "" {
+			public = true
+			continue
+		}
+		query := url.Values{"tag": {strings.TrimPrefix(p.Hashtag, "#")}}
+		if local {
+			streams = append(streams, "/api/v1/streaming/hashtag/local?"+query.Encode())
+		} else {
+			streams = append(streams, "/api/v1/streaming/hashtag?"+query.Encode())
+		}
+	}
+	if public {
+		if local {
+			streams = append(streams, "/api/v1/streaming/public/local")
+		} else {
+			streams = append(streams, "/api/v1/streaming/public")
+		}
+	}
+	return streams
+}
+
+// stream reads the Server-Sent Events of a timeline, calling fn with
+// every new status.
+func (m *mastodonSource) stream(ctx context.Context, path string, fn func(mastodonStatus)) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, m.instance+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+m.token)
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("GET %s: %s: %s", path, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	log.Println("connected to mastodon", path)
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	var event string
+	var data strings.Builder
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			// blank lines end events
+			if event == "update" {
+				var s mastodonStatus
+				if err := json.Unmarshal([]byte(data.String()), &s); err != nil {
+					log.Println("error decoding mastodon status:", err)
+				} else {
+					fn(s)
+				}
+			}
+			event = ""
+			data.Reset()
+		case strings.HasPrefix(line, ":"):
+			// heartbeat comment
+		case strings.HasPrefix(line, "event:"):
+			event = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			if data.Len() > 0 {
+				data.WriteByte('\n')
+			}
+			data.WriteString(strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("error reading %s: %w", path, err)
+	}
+	return fmt.Errorf("%s: %w", path, io.ErrUnexpectedEOF)
+}
+
+// stripHTML returns the text of status content: tags are removed, line
+// and paragraph breaks become spaces and entities are unescaped.
+func stripHTML(content string) string {
+	var b strings.Builder
+	for {
+		start := strings.IndexByte(content, '<')
+		if start < 0 {
+			b.WriteString(content)
+			break
+		}
+		b.WriteString(content[:start])
+		end := strings.IndexByte(content[start:], '>')
+		if end < 0 {
+			break
+		}
+		tag := strings.ToLower(content[start+1 : start+end])
+		if strings.HasPrefix(tag, "br") || strings.HasPrefix(tag, "/p") {
+			b.WriteByte(' ')
+		}
+		content = content[start+end+1:]
+	}
+	return strings.TrimSpace(html.UnescapeString(b.String()))
+}
+
+// seenStatuses remembers the most recent status IDs, so that a status
+// delivered by several timelines is only counted once.
+type seenStatuses struct {
+	mu    sync.Mutex
+	ids   map[string]bool
+	order []string
+}
+
+const maxSeenStatuses = 1000
+
+func newSeenStatuses() *seenStatuses {
+	return &seenStatuses{ids: make(map[string]bool)}
+}
+
+// add reports whether id had not been seen yet.
+func (s *seenStatuses) add(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ids[id] {
+		return false
+	}
+	s.ids[id] = true
+	s.order = append(s.order, id)
+	if len(s.order) > maxSeenStatuses {
+		delete(s.ids, s.order[0])
+		s.order = s.order[1:]
+	}
+	return true
+}
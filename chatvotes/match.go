@@ -0,0 +1,379 @@
+package main
+
+import (
+	"log"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// match modes
+const (
+	matchWord    = "word"    // options match as whole words, the default
+	matchHashtag = "hashtag" // options only match as hashtags, like #yes
+)
+
+// rules for messages mentioning several options of a single choice poll
+const (
+	multipleAll   = "all"   // every option counts, the default
+	multipleFirst = "first" // the option mentioned first counts
+	multipleNone  = "none"  // no option counts
+)
+
+// matchRules are the settings of a poll for matching its options, stored
+// with the poll as "match".
+type matchRules struct {
+	Mode     string              `bson:"mode"`
+	Multiple string              `bson:"multiple"`
+	Aliases  map[string][]string `bson:"aliases"`  // other ways to mention each option
+	Patterns map[string]string   `bson:"patterns"` // regexp matching each option
+}
+
+// match is an option found in a message, attributed to a single poll.
+// Approval and ranked-choice polls get a single match for the whole
+// ballot, with the options in Options and the first of them in Option.
+type match struct {
+	PollID  string
+	Option  string
+	Options []string
+	Flags   []string
+}
+
+// token is a word, hashtag or symbol in a message.
+type token struct {
+	text    string // lower case, without the # of hashtags
+	hashtag bool
+	pos     int // byte offset in the message
+	end     int // byte offset after the token in the message
+}
+
+// tokenize splits text into tokens. Words are runs of letters, digits and
+// marks in any script, and may contain apostrophes, as in "don't". Any
+// other symbol, such as an emoji, is a token of its own, without skin tone
+// modifiers or variation selectors.
+func tokenize(text string) []token {
+	var tokens []token
+	var word strings.Builder
+	start, end, hashtag := 0, 0, false
+	flush := func() {
+		if word.Len() > 0 {
+			tokens = append(tokens, token{text: word.String(), hashtag: hashtag, pos: start, end: end})
+			word.Reset()
+		}
+		hashtag = false
+	}
+	for i, r := range text {
+		switch {
+		case isModifier(r):
+		case isWordRune(r):
+			if word.Len() == 0 && !hashtag {
+				start = i
+			}
+			word.WriteRune(unicode.ToLower(r))
+			end = i + utf8.RuneLen(r)
+		case (r == '\'' || r == '’') && word.Len() > 0 && nextIsWordRune(text[i+utf8.RuneLen(r):]):
+			word.WriteRune('\'')
+		case r == '#' && nextIsWordRune(text[i+1:]):
+			flush()
+			start, hashtag = i, true
+		case unicode.IsSymbol(r):
+			flush()
+			tokens = append(tokens, token{text: string(r), pos: i, end: i + utf8.RuneLen(r)})
+		default:
+			flush()
+		}
+	}
+	flush()
+	return tokens
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.IsMark(r) || r == '_'
+}
+
+func nextIsWordRune(s string) bool {
+	r, _ := utf8.DecodeRuneInString(s)
+	return isWordRune(r)
+}
+
+// isModifier reports whether r only modifies the symbol before it.
+func isModifier(r rune) bool {
+	return r == '\u200d' || // zero width joiner
+		(r >= '\ufe00' && r <= '\ufe0f') || // variation selectors
+		(r >= '\U0001f3fb' && r <= '\U0001f3ff') // skin tones
+}
+
+// words returns the texts of the tokens of s.
+func words(s string) []string {
+	var texts []string
+	for _, t := range tokenize(s) {
+		texts = append(texts, t.text)
+	}
+	return texts
+}
+
+// optionMatcher finds the mentions of an option.
+type optionMatcher struct {
+	option  string
+	key     string     // the option's words, identifying it across polls
+	terms   [][]string // the option and its aliases, as words
+	pattern *regexp.Regexp
+}
+
+// mention is where a message mentions an option: at byte offset pos, as
+// the tokens start to end. Pattern matches may cover no whole token.
+type mention struct {
+	option     string
+	pos        int
+	start, end int
+	stance     stance
+}
+
+// find returns the first mention of the option in the message.
+func (om *optionMatcher) find(text string, tokens []token, mode string) (mention, bool) {
+	first := mention{option: om.option, pos: -1}
+	found := func(m mention) {
+		if first.pos < 0 || m.pos < first.pos {
+			first = m
+		}
+	}
+	for _, term := range om.terms {
+		if len(term) == 0 {
+			continue
+		}
+		for i := range tokens {
+			if mode == matchHashtag {
+				if tokens[i].hashtag && tokens[i].text == strings.Join(term, "") {
+					found(mention{option: om.option, pos: tokens[i].pos, start: i, end: i + 1})
+					break
+				}
+				continue
+			}
+			if i+len(term) <= len(tokens) && slices.EqualFunc(tokens[i:i+len(term)], term, func(t token, w string) bool { return t.text == w }) {
+				found(mention{option: om.option, pos: tokens[i].pos, start: i, end: i + len(term)})
+				break
+			}
+		}
+	}
+	if om.pattern != nil {
+		if loc := om.pattern.FindStringIndex(text); loc != nil {
+			m := mention{option: om.option, pos: loc[0], start: len(tokens)}
+			for i, t := range tokens {
+				if t.pos >= loc[0] && m.start == len(tokens) {
+					m.start = i
+				}
+				if t.pos < loc[1] {
+					m.end = i + 1
+				}
+			}
+			m.end = max(m.start, m.end)
+			found(m)
+		}
+	}
+	return first, first.pos >= 0
+}
+
+// pollMatcher finds the options of a poll mentioned in messages.
+type pollMatcher struct {
+	poll     poll
+	tag      string // lower case, without the #
+	mode     string
+	multiple string
+	options  []*optionMatcher
+}
+
+func newPollMatcher(p poll) *pollMatcher {
+	pm := &pollMatcher{poll: p, mode: matchWord, multiple: multipleAll}
+	if p.Hashtag != "" {
+		pm.tag = strings.Join(words(strings.TrimPrefix(p.Hashtag, "#")), "")
+	}
+	var rules matchRules
+	if p.Match != nil {
+		rules = *p.Match
+	}
+	if rules.Mode != "" {
+		pm.mode = rules.Mode
+	}
+	if rules.Multiple != "" {
+		pm.multiple = rules.Multiple
+	}
+	for _, option := range p.Options {
+		om := &optionMatcher{option: option, key: strings.Join(words(option), " ")}
+		om.terms = append(om.terms, words(option))
+		for _, alias := range rules.Aliases[option] {
+			om.terms = append(om.terms, words(alias))
+		}
+		if pattern := rules.Patterns[option]; pattern != "" {
+			re, err := regexp.Compile("(?i)" + pattern)
+			if err != nil {
+				log.Printf("ignoring invalid pattern for option %q of poll %s: %v", option, p.ID.Hex(), err)
+			} else {
+				om.pattern = re
+			}
+		}
+		pm.options = append(pm.options, om)
+	}
+	return pm
+}
+
+// interpret applies the -interpret-policy to the mentions spoken against,
+// returning the options voted for, without duplicates, and the flags of
+// the vote for each option.
+func (pm *pollMatcher) interpret(mentions []mention) ([]string, map[string][]string) {
+	var options []string
+	flags := make(map[string][]string)
+	for _, m := range mentions {
+		option := m.option
+		if m.stance == stanceAgainst {
+			switch *interpretPolicy {
+			case policyDrop:
+				log.Printf("dropping vote against %q in poll %s\n", option, pm.poll.ID.Hex())
+				continue
+			case policyInvert:
+				if len(pm.poll.Options) != 2 || pm.poll.Type == typeApproval || pm.poll.Type == typeRanked {
+					log.Printf("dropping vote against %q in poll %s, which has no single other option\n", option, pm.poll.ID.Hex())
+					continue
+				}
+				option = pm.poll.Options[0]
+				if option == m.option {
+					option = pm.poll.Options[1]
+				}
+			case policyFlag:
+				if !slices.Contains(flags[option], flagNegated) {
+					flags[option] = append(flags[option], flagNegated)
+				}
+			}
+		}
+		if !slices.Contains(options, option) {
+			options = append(options, option)
+		}
+	}
+	return options, flags
+}
+
+// matcher finds the poll options mentioned in messages.
+type matcher struct {
+	polls []*pollMatcher
+	// owners counts how many polls without a hashtag offer each option
+	owners map[string]int
+}
+
+func newMatcher(polls []poll) *matcher {
+	m := &matcher{owners: make(map[string]int)}
+	for _, p := range polls {
+		pm := newPollMatcher(p)
+		m.polls = append(m.polls, pm)
+		if pm.tag != "" {
+			continue
+		}
+		for _, om := range pm.options {
+			m.owners[om.key]++
+		}
+	}
+	return m
+}
+
+// match finds the poll options mentioned in text.
+//
+// Options match as whole words, in any letter case and script, or only as
+// hashtags for polls in hashtag mode. Aliases and patterns set for an
+// option match it too.
+//
+// A poll with a hashtag only receives votes from messages that mention
+// its hashtag. Polls without a hashtag receive votes for any option
+// they own exclusively; an option shared by several such polls cannot
+// be attributed and is ignored rather than counted against all of them.
+//
+// The options mentioned for a plurality or weighted poll are votes of
+// their own, all of them, the first, or none of them if there are several,
+// as the poll's multiple rule says. Approval polls receive a single vote
+// for all the options mentioned, and ranked-choice polls a single vote
+// ranking them in the order they are mentioned.
+//
+// Mentions spoken against, such as "not happy", are interpreted by the
+// interpreter for the message's language lang, when one is set, and
+// dropped, inverted or flagged as the -interpret-policy says.
+//
+// Polls that closed since they were loaded receive no votes.
+func (m *matcher) match(text, lang string) []match {
+	tokens := tokenize(text)
+	interpreter := interpreterFor(lang)
+	now := time.Now()
+	var matches []match
+	for _, pm := range m.polls {
+		if !pm.poll.isOpen(now) {
+			continue
+		}
+		if pm.tag != "" && !slices.ContainsFunc(tokens, func(t token) bool { return t.hashtag && t.text == pm.tag }) {
+			continue
+		}
+		var found []mention
+		for _, om := range pm.options {
+			mention, ok := om.find(text, tokens, pm.mode)
+			if !ok {
+				continue
+			}
+			if pm.tag == "" && m.owners[om.key] > 1 {
+				log.Printf("ignoring ambiguous vote %q: option belongs to %d polls\n", om.option, m.owners[om.key])
+				continue
+			}
+			if interpreter != nil && mention.start < mention.end {
+				mention.stance = interpreter.Stance(text, tokens, mention.start, mention.end)
+			}
+			found = append(found, mention)
+		}
+		slices.SortStableFunc(found, func(a, b mention) int { return a.pos - b.pos })
+		options, flags := pm.interpret(found)
+		if len(options) == 0 {
+			continue
+		}
+		id := pm.poll.ID.Hex()
+		switch pm.poll.Type {
+		case typeApproval, typeRanked:
+			// a ballot carries the flags of all of its options
+			var ballotFlags []string
+			for _, option := range options {
+				for _, f := range flags[option] {
+					if !slices.Contains(ballotFlags, f) {
+						ballotFlags = append(ballotFlags, f)
+					}
+				}
+			}
+			matches = append(matches, match{PollID: id, Option: options[0], Options: options, Flags: ballotFlags})
+			continue
+		}
+		switch {
+		case len(options) > 1 && pm.multiple == multipleNone:
+			log.Printf("ignoring votes for %q in poll %s: several options mentioned\n", options, id)
+		case pm.multiple == multipleFirst:
+			matches = append(matches, match{PollID: id, Option: options[0], Flags: flags[options[0]]})
+		default:
+			for _, option := range options {
+				matches = append(matches, match{PollID: id, Option: option, Flags: flags[option]})
+			}
+		}
+	}
+	return matches
+}
+
+// trackKeywords returns the keywords to filter a stream by so that
+// every poll in polls can receive votes.
+func trackKeywords(polls []poll) []string {
+	var keywords []string
+	for _, p := range polls {
+		if p.Hashtag != "" {
+			keywords = append(keywords, "#"+strings.TrimPrefix(p.Hashtag, "#"))
+			continue
+		}
+		keywords = append(keywords, p.Options...)
+		if p.Match != nil {
+			for _, aliases := range p.Match.Aliases {
+				keywords = append(keywords, aliases...)
+			}
+		}
+	}
+	return keywords
+}
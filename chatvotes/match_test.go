@@ -0,0 +1,28 @@
+package main
+
+import (
+	"slices"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestMatchFlagsEachOption(t *testing.T) {
+	defer func(lang, policy string) { *interpretLang, *interpretPolicy = lang, policy }(*interpretLang, *interpretPolicy)
+	*interpretLang, *interpretPolicy = "en", policyFlag
+
+	m := newMatcher([]poll{{ID: primitive.NewObjectID(), Options: []string{"happy", "sad"}}})
+	got := map[string][]string{}
+	for _, mt := range m.match("I'm happy, not sad", "en") {
+		got[mt.Option] = mt.Flags
+	}
+	if len(got) != 2 {
+		t.Fatalf("matched %v, want happy and sad", got)
+	}
+	if len(got["happy"]) != 0 {
+		t.Errorf("happy is flagged %q", got["happy"])
+	}
+	if !slices.Equal(got["sad"], []string{flagNegated}) {
+		t.Errorf("sad is flagged %q, want %q", got["sad"], flagNegated)
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// outboxSegmentSize is the size at which the outbox starts a new segment.
+const outboxSegmentSize = 4 << 20
+
+var errOutboxFull = errors.New("outbox is full")
+
+// outbox is a disk-backed FIFO queue of encoded votes waiting to be
+// published. Votes are appended to numbered segment files, one per line,
+// and a cursor file records how far they have been published, so the
+// queue survives restarts. Segments are deleted once fully published.
+//
+// An outbox is not safe for concurrent use, except for len.
+type outbox struct {
+	dir      string
+	maxBytes int64
+
+	segments []int64 // oldest first, the last one is written to
+	w        *os.File
+	wSize    int64
+	bytes    int64 // total size of the segments
+
+	// the cursor, at the oldest unpublished vote
+	rSeg    int64
+	rOff    int64
+	r       *os.File
+	rd      *bufio.Reader
+	pending int64 // size of the vote returned by peek
+
+	depth atomic.Int64
+}
+
+func segmentPath(dir string, n int64) string {
+	return filepath.Join(dir, fmt.Sprintf("%016d.seg", n))
+}
+
+// openOutbox opens the outbox in dir, creating it if needed. The segments
+// may take up at most maxBytes.
+func openOutbox(dir string, maxBytes int64) (*outbox, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	o := &outbox{dir: dir, maxBytes: maxBytes}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		name, ok := strings.CutSuffix(e.Name(), ".seg")
+		if !ok {
+			continue
+		}
+		n, err := strconv.ParseInt(name, 10, 64)
+		if err != nil {
+			continue
+		}
+		o.segments = append(o.segments, n)
+	}
+	slices.Sort(o.segments)
+
+	if b, err := os.ReadFile(filepath.Join(dir, "cursor")); err == nil {
+		fmt.Sscan(string(b), &o.rSeg, &o.rOff)
+	}
+	// drop the segments published before the cursor
+	for len(o.segments) > 0 && o.segments[0] < o.rSeg {
+		os.Remove(segmentPath(dir, o.segments[0]))
+		o.segments = o.segments[1:]
+	}
+	if len(o.segments) == 0 {
+		o.segments = []int64{max(o.rSeg, 1)}
+	}
+	if o.rSeg != o.segments[0] {
+		o.rSeg, o.rOff = o.segments[0], 0
+	}
+
+	for i, n := range o.segments {
+		b, err := os.ReadFile(segmentPath(dir, n))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		if i == len(o.segments)-1 {
+			// drop a vote torn by a crash while it was appended
+			b = b[:bytes.LastIndexByte(b, '\n')+1]
+			if err := os.WriteFile(segmentPath(dir, n), b, 0o644); err != nil {
+				return nil, err
+			}
+			o.wSize = int64(len(b))
+		}
+		o.bytes += int64(len(b))
+		if n == o.rSeg {
+			b = b[min(o.rOff, int64(len(b))):]
+		}
+		o.depth.Add(int64(bytes.Count(b, []byte{'\n'})))
+	}
+	o.w, err = os.OpenFile(segmentPath(dir, o.segments[len(o.segments)-1]), os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return o, o.saveCursor()
+}
+
+// len returns the number of votes in the outbox.
+func (o *outbox) len() int64 {
+	return o.depth.Load()
+}
+
+// append adds an encoded vote to the end of the outbox.
+func (o *outbox) append(body []byte) error {
+	line := append(slices.Clip(body), '\n')
+	if o.bytes+int64(len(line)) > o.maxBytes {
+		return errOutboxFull
+	}
+	if o.wSize > 0 && o.wSize+int64(len(line)) > outboxSegmentSize {
+		if err := o.rotate(); err != nil {
+			return err
+		}
+	}
+	if _, err := o.w.Write(line); err != nil {
+		return err
+	}
+	o.wSize += int64(len(line))
+	o.bytes += int64(len(line))
+	o.depth.Add(1)
+	return nil
+}
+
+// rotate starts a new segment to append to.
+func (o *outbox) rotate() error {
+	n := o.segments[len(o.segments)-1] + 1
+	w, err := os.OpenFile(segmentPath(o.dir, n), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	o.w.Close()
+	o.w, o.wSize = w, 0
+	o.segments = append(o.segments, n)
+	return nil
+}
+
+// peek returns the oldest vote in the outbox, or nil if it is empty.
+func (o *outbox) peek() ([]byte, error) {
+	for o.len() > 0 {
+		if o.r == nil {
+			r, err := os.Open(segmentPath(o.dir, o.rSeg))
+			if err != nil {
+				return nil, err
+			}
+			if _, err := r.Seek(o.rOff, io.SeekStart); err != nil {
+				r.Close()
+				return nil, err
+			}
+			o.r, o.rd = r, bufio.NewReader(r)
+		}
+		line, err := o.rd.ReadBytes('\n')
+		if err == nil {
+			o.pending = int64(len(line))
+			return line[:len(line)-1], nil
+		}
+		o.r.Close()
+		o.r = nil
+		if err != io.EOF {
+			return nil, err
+		}
+		if o.rSeg == o.segments[len(o.segments)-1] {
+			break
+		}
+		// the segment is fully published
+		if err := o.dropSegment(); err != nil {
+			return nil, err
+		}
+	}
+	return nil, nil
+}
+
+// commit removes the vote returned by peek from the outbox.
+func (o *outbox) commit() error {
+	if o.pending == 0 {
+		return nil
+	}
+	o.rOff += o.pending
+	o.pending = 0
+	if o.depth.Add(-1) == 0 {
+		// start afresh rather than keep published segments around
+		if err := o.rotate(); err != nil {
+			return err
+		}
+		for len(o.segments) > 1 {
+			if err := o.dropSegment(); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return o.saveCursor()
+}
+
+// dropSegment deletes the oldest segment, moving the cursor to the next.
+func (o *outbox) dropSegment() error {
+	if o.r != nil {
+		o.r.Close()
+		o.r = nil
+	}
+	path := segmentPath(o.dir, o.segments[0])
+	if fi, err := os.Stat(path); err == nil {
+		o.bytes -= fi.Size()
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	o.segments = o.segments[1:]
+	o.rSeg, o.rOff = o.segments[0], 0
+	return o.saveCursor()
+}
+
+func (o *outbox) saveCursor() error {
+	path := filepath.Join(o.dir, "cursor")
+	if err := os.WriteFile(path+".tmp", fmt.Appendf(nil, "%d %d\n", o.rSeg, o.rOff), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+func (o *outbox) close() error {
+	if o.r != nil {
+		o.r.Close()
+	}
+	return o.w.Close()
+}
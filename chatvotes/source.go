@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// reconnectDelay is how long a source waits before reconnecting after
+// its connection ends.
+const reconnectDelay = 10 * time.Second
+
+// message is a message read from a vote source.
+type message struct {
+	Text      string
+	AuthorID  string
+	MessageID string
+	// Lang is the language of the message, if the source knows
+	Lang string
+	// Source overrides the name of the source as the source of its votes
+	Source string
+	// When is when the message was sent, if the source knows
+	When time.Time
+}
+
+// VoteSource is somewhere messages carrying votes come from, such as a
+// chat server or a social network.
+type VoteSource interface {
+	// Name identifies the source, and is the source of its votes.
+	Name() string
+	// Run connects to the source and emits the messages it reads until
+	// ctx is cancelled or the connection ends.
+	Run(ctx context.Context, emit func(message)) error
+}
+
+// sourceFactories create the vote sources by name.
+var sourceFactories = map[string]func() (VoteSource, error){
+	sourceChat:     newChatSource,
+	sourceTwitter:  newTwitterSource,
+	sourceMastodon: newMastodonSource,
+	sourceIRC:      newIRCSource,
+	sourceWebhook:  newWebhookSource,
+}
+
+// newSources creates the sources named in the comma separated list.
+func newSources(names string) ([]VoteSource, error) {
+	var sources []VoteSource
+	for name := range strings.SplitSeq(names, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		factory, ok := sourceFactories[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown vote source %q", name)
+		}
+		src, err := factory()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		sources = append(sources, src)
+	}
+	if len(sources) == 0 {
+		return nil, fmt.Errorf("no vote sources in %q", names)
+	}
+	return sources, nil
+}
+
+// envOr returns the environment variable, or def if it is not set.
+func envOr(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+// supervise runs the source until ctx is cancelled, reconnecting after
+// reconnectDelay whenever its connection ends. Votes for the options of
+// the current open polls matched in the source's messages are sent to
+// votes.
+func supervise(ctx context.Context, src VoteSource, votes chan<- vote) {
+	for {
+		log.Println("connecting to", src.Name())
+		err := src.Run(ctx, func(msg message) {
+			for _, m := range currentPolls().matcher.match(msg.Text, msg.Lang) {
+				log.Println("vote:", m.Option, "poll:", m.PollID, "source:", src.Name())
+				source := src.Name()
+				if msg.Source != "" {
+					source = msg.Source
+				}
+				v := newVote(source, m.Option)
+				v.Options = m.Options
+				v.Flags = m.Flags
+				v.PollID = m.PollID
+				v.AuthorID = msg.AuthorID
+				v.MessageID = msg.MessageID
+				if !msg.When.IsZero() {
+					v.Timestamp = msg.When.UTC()
+				}
+				select {
+				case votes <- v:
+				case <-ctx.Done():
+					return
+				}
+			}
+		})
+		if err != nil && ctx.Err() == nil {
+			log.Printf("%s: %v", src.Name(), err)
+		}
+		select {
+		case <-ctx.Done():
+			log.Println("stopped", src.Name())
+			return
+		case <-time.After(reconnectDelay):
+			log.Println("reconnecting to", src.Name())
+		}
+	}
+}
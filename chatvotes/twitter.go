@@ -1,166 +1,256 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"encoding/json"
+	"fmt"
 	"io"
 	"log"
-	"net"
 	"net/http"
 	"net/url"
-	"strconv"
+	"slices"
 	"strings"
-	"sync"
 	"time"
 
-	"github.com/gomodule/oauth1/oauth"
 	"github.com/joeshaw/envdecode"
 )
 
-var conn net.Conn
+// twitterRuleTag prefixes the tags of the stream rules chatvotes manages,
+// so that rules added by anything else sharing the app are left alone.
+const twitterRuleTag = "socialpoll:"
 
-func dial(netw, addr string) (net.Conn, error) {
-	if conn != nil {
-		conn.Close()
-		conn = nil
+// twitterSource reads votes from the Twitter API v2 filtered stream. The
+// stream rules are synced from the open polls on connecting and whenever
+// they change, without reconnecting.
+type twitterSource struct {
+	baseURL string
+	token   string
+	client  *http.Client
+}
+
+func newTwitterSource() (VoteSource, error) {
+	var ts struct {
+		BearerToken string `env:"SP_TWITTER__BEARERTOKEN,required"`
+		BaseURL     string `env:"SP_TWITTER__BASEURL,default=https://api.twitter.com"`
 	}
-	netc, err := net.DialTimeout(netw, addr, 5*time.Second)
-	if err != nil {
+	if err := envdecode.Decode(&ts); err != nil {
 		return nil, err
 	}
-	conn = netc
-	return conn, nil
+	return &twitterSource{
+		baseURL: strings.TrimSuffix(ts.BaseURL, "/"),
+		token:   ts.BearerToken,
+		// no timeout, the stream stays open
+		client: &http.Client{},
+	}, nil
 }
 
-var reader io.ReadCloser
+func (*twitterSource) Name() string { return sourceTwitter }
 
-func closeConn() {
-	if conn != nil {
-		conn.Close()
-	}
-	if reader != nil {
-		reader.Close()
-	}
+// twitterRule is a filtered stream rule.
+type twitterRule struct {
+	ID    string `json:"id,omitempty"`
+	Value string `json:"value"`
+	Tag   string `json:"tag,omitempty"`
 }
 
-var (
-	authClient *oauth.Client
-	creds      *oauth.Credentials
-)
+// twitterEvent is a tweet delivered by the filtered stream, with its author
+// expanded.
+type twitterEvent struct {
+	Data struct {
+		ID        string    `json:"id"`
+		Text      string    `json:"text"`
+		AuthorID  string    `json:"author_id"`
+		CreatedAt time.Time `json:"created_at"`
+		Lang      string    `json:"lang"`
+	} `json:"data"`
+	Includes struct {
+		Users []struct {
+			ID       string `json:"id"`
+			Username string `json:"username"`
+		} `json:"users"`
+	} `json:"includes"`
+}
 
-func setupTwitterAuth() {
-	var ts struct {
-		ConsumerKey    string `env:"SP_TWITTER__KEY, required"`
-		ConsumerSecret string `env:"SP_TWITTER__SECRET, required"`
-		AccessToken    string `env:"SP_TWITTER__ACCESSTOKEN, required"`
-		AccessSecret   string `env:"SP_TWITTER__ACCESSSECRET, required"`
-	}
-	if err := envdecode.Decode(&ts); err != nil {
-		log.Fatalln(err)
+// Run syncs the stream rules with the open polls, then connects to the
+// filtered stream and emits the tweets it receives.
+func (t *twitterSource) Run(ctx context.Context, emit func(message)) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	polls := currentPolls()
+	if err := t.syncRules(ctx, twitterRules(polls.polls)); err != nil {
+		return fmt.Errorf("failed to sync stream rules: %w", err)
 	}
-	creds = &oauth.Credentials{
-		Token:  ts.AccessToken,
-		Secret: ts.AccessSecret,
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-polls.changed:
+			}
+			polls = currentPolls()
+			if err := t.syncRules(ctx, twitterRules(polls.polls)); err != nil && ctx.Err() == nil {
+				log.Println("failed to sync stream rules:", err)
+			}
+		}
+	}()
+
+	query := url.Values{
+		"tweet.fields": {"author_id,created_at,lang"},
+		"expansions":   {"author_id"},
+		"user.fields":  {"username"},
 	}
-	authClient = &oauth.Client{
-		Credentials: oauth.Credentials{
-			Token:  ts.ConsumerKey,
-			Secret: ts.ConsumerSecret,
-		},
+	resp, err := t.do(ctx, http.MethodGet, "/2/tweets/search/stream?"+query.Encode(), nil)
+	if err != nil {
+		return err
 	}
-}
+	defer resp.Body.Close()
+	log.Println("connected to the Twitter filtered stream")
 
-var (
-	authSetupOnce sync.Once
-	httpClient    *http.Client
-)
-
-func makeRequest(req *http.Request, params url.Values) (*http.Response, error) {
-	authSetupOnce.Do(func() {
-		setupTwitterAuth()
-		httpClient = &http.Client{
-			Transport: &http.Transport{
-				Dial: dial,
-			},
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			// keep-alive
+			continue
+		}
+		var e twitterEvent
+		if err := json.Unmarshal(line, &e); err != nil {
+			log.Println("error decoding tweet:", err)
+			continue
 		}
-	})
-	formEnc := params.Encode()
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	req.Header.Set("Content-Length", strconv.Itoa(len(formEnc)))
-	req.Header.Set("Authorization", authClient.AuthorizationHeader(creds, "POST", req.URL, params))
-	return httpClient.Do(req)
+		author := e.Data.AuthorID
+		for _, u := range e.Includes.Users {
+			if u.ID == author {
+				log.Printf("tweet %s by @%s", e.Data.ID, u.Username)
+			}
+		}
+		emit(message{Text: e.Data.Text, AuthorID: author, MessageID: e.Data.ID, When: e.Data.CreatedAt, Lang: e.Data.Lang})
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("error reading stream: %w", err)
+	}
+	return io.ErrUnexpectedEOF
 }
 
-type tweet struct {
-	Text string
+// twitterRules returns the stream rules matching the votes of the polls:
+// their hashtag, or any of their options.
+func twitterRules(polls []poll) []twitterRule {
+	var rules []twitterRule
+	for _, p := range polls {
+		var terms []string
+		for _, keyword := range trackKeywords([]poll{p}) {
+			if !strings.HasPrefix(keyword, "#") {
+				keyword = `"` + strings.ReplaceAll(keyword, `"`, ``) + `"`
+			}
+			terms = append(terms, keyword)
+		}
+		if len(terms) == 0 {
+			continue
+		}
+		rules = append(rules, twitterRule{Value: strings.Join(terms, " OR "), Tag: twitterRuleTag + p.ID.Hex()})
+	}
+	return rules
 }
 
-func readFromTwitter(votes chan<- string) {
-	options, err := loadOptions()
+// syncRules replaces the stream rules chatvotes manages with want, leaving
+// unchanged rules in place.
+func (t *twitterSource) syncRules(ctx context.Context, want []twitterRule) error {
+	resp, err := t.do(ctx, http.MethodGet, "/2/tweets/search/stream/rules", nil)
 	if err != nil {
-		log.Fatalln("failed to load options:", err)
-		return
+		return err
 	}
-
-	u, err := url.Parse("https://stream.twitter.com/1.1/statuses/filter.json")
-	if err != nil {
-		log.Println("creating filter request failed:", err)
-		return
+	var current struct {
+		Data []twitterRule `json:"data"`
 	}
-	query := make(url.Values)
-	query.Set("track", strings.Join(options, ","))
-	req, err := http.NewRequest("POST", u.String(), strings.NewReader(query.Encode()))
+	err = json.NewDecoder(resp.Body).Decode(&current)
+	resp.Body.Close()
 	if err != nil {
-		log.Println("creating filter request failed:", err)
-		return
+		return err
 	}
-	resp, err := makeRequest(req, query)
-	if err != nil {
-		log.Println("making filter request failed:", err)
-		return
-	}
-	reader := resp.Body
-	decoder := json.NewDecoder(reader)
-	for {
-		var t tweet
-		if err := decoder.Decode(&t); err != nil {
-			log.Println("error decoding tweet:", err)
-			break
+
+	keep := make(map[twitterRule]bool)
+	var stale []string
+	for _, rule := range current.Data {
+		if !strings.HasPrefix(rule.Tag, twitterRuleTag) {
+			continue
 		}
-		for _, option := range options {
-			if strings.Contains(
-				strings.ToLower(t.Text),
-				strings.ToLower(option),
-			) {
-				log.Println("vote:", option)
-				// send the vote to the votes channel
-				votes <- option
-			}
+		id := rule.ID
+		rule.ID = ""
+		if keep[rule] || !slices.Contains(want, rule) {
+			stale = append(stale, id)
+			continue
+		}
+		keep[rule] = true
+	}
+	var add []twitterRule
+	for _, rule := range want {
+		if !keep[rule] {
+			add = append(add, rule)
 		}
 	}
-}
 
-func startTwitterStream(stopchan <-chan struct{}, votes chan<- string) <-chan struct{} {
-	// stoppedchan is closed when the Twitter reading goroutine stops.
-	// 1 buffer to ensure no blocking on stop.
-	stoppedchan := make(chan struct{}, 1)
-	go func() {
-		defer func() {
-			stoppedchan <- struct{}{}
-		}()
-		for {
-			select {
-			// Check if we need to stop
-			case <-stopchan:
-				log.Println("stopping Twitter...")
-				return
-			// Default case to run the Twitter reading
-			default:
-				log.Println("Quering Twitter...")
-				readFromTwitter(votes)
-				log.Println("Reconnecting to Twitter in 10 seconds...")
-				time.Sleep(10 * time.Second) // wait before reconnecting
-			}
+	if len(stale) > 0 {
+		body := map[string]any{"delete": map[string][]string{"ids": stale}}
+		if err := t.postRules(ctx, body); err != nil {
+			return err
 		}
-	}()
-	return stoppedchan
+	}
+	if len(add) > 0 {
+		if err := t.postRules(ctx, map[string]any{"add": add}); err != nil {
+			return err
+		}
+	}
+	log.Printf("twitter stream rules: %d kept, %d added, %d deleted", len(keep), len(add), len(stale))
+	return nil
+}
+
+func (t *twitterSource) postRules(ctx context.Context, body any) error {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	resp, err := t.do(ctx, http.MethodPost, "/2/tweets/search/stream/rules", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var result struct {
+		Errors []struct {
+			Title  string `json:"title"`
+			Detail string `json:"detail"`
+		} `json:"errors"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return err
+	}
+	if len(result.Errors) > 0 {
+		return fmt.Errorf("%s: %s", result.Errors[0].Title, result.Errors[0].Detail)
+	}
+	return nil
+}
+
+// do sends an authenticated request to the API, returning an error for
+// any response but 200 OK or 201 Created.
+func (t *twitterSource) do(ctx context.Context, method, path string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, t.baseURL+path, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+t.token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		defer resp.Body.Close()
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, bytes.TrimSpace(msg))
+	}
+	return resp, nil
 }
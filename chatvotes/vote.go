@@ -0,0 +1,28 @@
+package main
+
+import (
+	"time"
+
+	"github.com/liyu-wang/go-socialpoll/broker"
+)
+
+// vote sources
+const (
+	sourceChat     = "chat"
+	sourceTwitter  = "twitter"
+	sourceMastodon = "mastodon"
+	sourceIRC      = "irc"
+	sourceWebhook  = "webhook"
+)
+
+// vote is the envelope published to the "votes" topic, see broker.Vote.
+type vote = broker.Vote
+
+func newVote(source, option string) vote {
+	return vote{
+		Version:   broker.VoteVersion,
+		Option:    option,
+		Source:    source,
+		Timestamp: time.Now().UTC(),
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"log"
+	"reflect"
+	"sync/atomic"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	// pollsReloadInterval is how often the polls are reloaded besides on
+	// changes, for polls opening and closing as their voting window passes.
+	pollsReloadInterval = 10 * time.Second
+	// pollsPollInterval is how often the polls are reloaded when change
+	// streams are unavailable, such as on a standalone mongod.
+	pollsPollInterval = 2 * time.Second
+)
+
+// pollSet is the set of open polls at some point, with the matcher for
+// them. It is replaced as a whole whenever the polls change.
+type pollSet struct {
+	polls   []poll
+	matcher *matcher
+	// changed is closed when the set is replaced
+	changed chan struct{}
+}
+
+var livePolls atomic.Pointer[pollSet]
+
+func init() {
+	livePolls.Store(&pollSet{matcher: newMatcher(nil), changed: make(chan struct{})})
+}
+
+// currentPolls returns the current set of open polls.
+func currentPolls() *pollSet {
+	return livePolls.Load()
+}
+
+// setPolls replaces the current set of open polls if polls differ from it,
+// reporting whether they did.
+func setPolls(polls []poll) bool {
+	old := livePolls.Load()
+	if reflect.DeepEqual(old.polls, polls) {
+		return false
+	}
+	livePolls.Store(&pollSet{polls: polls, matcher: newMatcher(polls), changed: make(chan struct{})})
+	close(old.changed)
+	return true
+}
+
+// reloadPolls loads the open polls into the current set, keeping the
+// previous set if they cannot be loaded.
+func reloadPolls() {
+	polls, err := loadOptions()
+	if err != nil {
+		log.Println("failed to reload polls:", err)
+		return
+	}
+	if setPolls(polls) {
+		log.Printf("polls changed, %d open\n", len(polls))
+	}
+}
+
+// pollChanges selects the changes to polls other than updates only to
+// their results, which the counter makes every second while votes flow.
+var pollChanges = mongo.Pipeline{
+	{{Key: "$match", Value: bson.M{"$expr": bson.M{"$or": bson.A{
+		bson.M{"$ne": bson.A{"$operationType", "update"}},
+		bson.M{"$gt": bson.A{
+			bson.M{"$size": bson.M{"$filter": bson.M{
+				"input": bson.M{"$concatArrays": bson.A{
+					bson.M{"$map": bson.M{
+						"input": bson.M{"$objectToArray": "$updateDescription.updatedFields"},
+						"in":    "$$this.k",
+					}},
+					bson.M{"$ifNull": bson.A{"$updateDescription.removedFields", bson.A{}}},
+				}},
+				"cond": bson.M{"$and": bson.A{
+					bson.M{"$ne": bson.A{"$$this", "results"}},
+					bson.M{"$ne": bson.A{bson.M{"$substrCP": bson.A{"$$this", 0, len("results.")}}, "results."}},
+				}},
+			}}},
+			0,
+		}},
+	}}}}},
+}
+
+// watchPolls keeps the current set of open polls up to date until ctx is
+// cancelled. It reloads them whenever the polls collection changes, using
+// a change stream, and falls back to polling when change streams are
+// unavailable.
+func watchPolls(ctx context.Context) {
+	if dbClient == nil {
+		return
+	}
+	c := dbClient.Database("ballots").Collection("polls")
+	cs, err := c.Watch(ctx, pollChanges)
+	if err != nil {
+		log.Println("change streams unavailable, polling polls:", err)
+		pollPolls(ctx, pollsPollInterval)
+		return
+	}
+	defer cs.Close(context.Background())
+	log.Println("watching polls for changes")
+
+	// coalesce bursts of changes into a single reload
+	changes := make(chan struct{}, 1)
+	go func() {
+		defer close(changes)
+		for cs.Next(ctx) {
+			select {
+			case changes <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	ticker := time.NewTicker(pollsReloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case _, ok := <-changes:
+			if !ok {
+				if ctx.Err() == nil {
+					log.Println("polls change stream ended, polling polls:", cs.Err())
+					pollPolls(ctx, pollsPollInterval)
+				}
+				return
+			}
+			reloadPolls()
+		case <-ticker.C:
+			reloadPolls()
+		}
+	}
+}
+
+// pollPolls reloads the polls every interval until ctx is cancelled.
+func pollPolls(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			reloadPolls()
+		}
+	}
+}
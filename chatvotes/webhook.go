@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/joeshaw/envdecode"
+)
+
+// webhookMaxBody is the largest message body the webhook accepts.
+const webhookMaxBody = 1 << 20
+
+// signature schemes
+const (
+	// schemeHMAC signs "{timestamp}.{body}" with the hex HMAC-SHA256 in
+	// Header, optionally prefixed with "sha256=", and the unix time in
+	// TimestampHeader
+	schemeHMAC = "hmac-sha256"
+	// schemeSlack is how Slack signs requests, such as slash commands:
+	// "v0=" and the hex HMAC-SHA256 of "v0:{timestamp}:{body}" in
+	// X-Slack-Signature, and the unix time in X-Slack-Request-Timestamp
+	schemeSlack = "slack"
+)
+
+// webhookTolerance is how far the timestamp of a message may be from the
+// time it is received, unless the integration says otherwise.
+const webhookTolerance = 5 * time.Minute
+
+// webhookIntegration is a service allowed to post messages to the
+// webhook, signing them with its secret.
+type webhookIntegration struct {
+	Secret string `json:"secret"`
+	// Scheme is how messages are signed, schemeHMAC by default.
+	Scheme string `json:"scheme"`
+	// Header and TimestampHeader hold the signature and timestamp of
+	// schemeHMAC messages, X-Signature and X-Timestamp by default.
+	Header          string `json:"header"`
+	TimestampHeader string `json:"timestamp_header"`
+	// Tolerance is how far the timestamp may be from now, in
+	// time.ParseDuration format.
+	Tolerance string `json:"tolerance"`
+	// Mapping holds the JSONPath of each field in the body, such as
+	// {"text": "$.event.text"}. Unmapped fields are read from the top
+	// level fields of the same name. Form bodies are read as an object
+	// of their fields.
+	Mapping map[string]string `json:"mapping"`
+
+	tolerance time.Duration
+}
+
+// slackMapping reads the fields of Slack slash commands.
+var slackMapping = map[string]string{"author": "$.user_id", "id": "$.trigger_id"}
+
+// webhookFields are the fields read from a message body.
+var webhookFields = []string{"text", "author", "id", "source"}
+
+// webhookSource receives messages POSTed by other services to
+// /webhooks/{integration}, as JSON such as
+// {"text": "I vote #poll yes", "author": "U123", "source": "slack"}.
+type webhookSource struct {
+	addr         string
+	integrations map[string]webhookIntegration
+
+	// seen holds the signatures of the messages received within their
+	// tolerance, so a message cannot be replayed while its timestamp is
+	// still accepted
+	mu   sync.Mutex
+	seen map[string]time.Time
+}
+
+func newWebhookSource() (VoteSource, error) {
+	var ws struct {
+		Addr   string `env:"SP_WEBHOOK__ADDR,default=:8090"`
+		Config string `env:"SP_WEBHOOK__CONFIG,required"`
+	}
+	if err := envdecode.Decode(&ws); err != nil {
+		return nil, err
+	}
+	integrations, err := loadWebhookIntegrations(ws.Config)
+	if err != nil {
+		return nil, err
+	}
+	return &webhookSource{addr: ws.Addr, integrations: integrations, seen: make(map[string]time.Time)}, nil
+}
+
+// loadWebhookIntegrations reads the integrations from a JSON file mapping
+// their names to their settings.
+func loadWebhookIntegrations(path string) (map[string]webhookIntegration, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var integrations map[string]webhookIntegration
+	if err := json.Unmarshal(b, &integrations); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for name, in := range integrations {
+		if in.Secret == "" {
+			return nil, fmt.Errorf("%s: integration %q has no secret", path, name)
+		}
+		switch in.Scheme {
+		case "":
+			in.Scheme = schemeHMAC
+		case schemeHMAC, schemeSlack:
+		default:
+			return nil, fmt.Errorf("%s: integration %q has an unknown scheme %q", path, name, in.Scheme)
+		}
+		in.tolerance = webhookTolerance
+		if in.Tolerance != "" {
+			d, err := time.ParseDuration(in.Tolerance)
+			if err != nil || d <= 0 {
+				return nil, fmt.Errorf("%s: integration %q has an invalid tolerance %q", path, name, in.Tolerance)
+			}
+			in.tolerance = d
+		}
+		if in.Scheme == schemeSlack {
+			mapping := maps.Clone(slackMapping)
+			maps.Copy(mapping, in.Mapping)
+			in.Mapping = mapping
+		}
+		integrations[name] = in
+		for field, path := range in.Mapping {
+			if _, err := parseJSONPath(path); err != nil {
+				return nil, fmt.Errorf("integration %q: %s: %w", name, field, err)
+			}
+		}
+	}
+	if len(integrations) == 0 {
+		return nil, fmt.Errorf("%s: no integrations", path)
+	}
+	return integrations, nil
+}
+
+func (*webhookSource) Name() string { return sourceWebhook }
+
+// Run listens for messages until ctx is cancelled.
+func (s *webhookSource) Run(ctx context.Context, emit func(message)) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /webhooks/{integration}", func(w http.ResponseWriter, r *http.Request) {
+		s.handleMessage(w, r, emit)
+	})
+	srv := &http.Server{Addr: s.addr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	stop := context.AfterFunc(ctx, func() {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	})
+	defer stop()
+	log.Println("listening for webhooks on", s.addr)
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+func (s *webhookSource) handleMessage(w http.ResponseWriter, r *http.Request, emit func(message)) {
+	name := r.PathValue("integration")
+	in, ok := s.integrations[name]
+	if !ok {
+		http.Error(w, "unknown integration", http.StatusNotFound)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, webhookMaxBody+1))
+	if err != nil {
+		http.Error(w, "failed to read body", http.StatusBadRequest)
+		return
+	}
+	if len(body) > webhookMaxBody {
+		http.Error(w, "body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	now := time.Now()
+	sig, err := in.verify(r.Header, body, now)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if !s.firstSeen(name+":"+hex.EncodeToString(sig), now.Add(in.tolerance), now) {
+		http.Error(w, "message already received", http.StatusConflict)
+		return
+	}
+	msg, err := in.decode(r.Header.Get("Content-Type"), body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// votes are attributed to the integration, and to the service it
+	// names within it
+	msg.Source = sourceWebhook + ":" + name + strings.TrimSuffix(":"+msg.Source, ":")
+	emit(msg)
+	if in.Scheme == schemeSlack {
+		// Slack shows anything but a 200 to the user as an error
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// firstSeen records a signature until it expires, reporting whether it
+// was not already recorded.
+func (s *webhookSource) firstSeen(sig string, expires, now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for seen, exp := range s.seen {
+		if now.After(exp) {
+			delete(s.seen, seen)
+		}
+	}
+	if _, ok := s.seen[sig]; ok {
+		return false
+	}
+	s.seen[sig] = expires
+	return true
+}
+
+// verify checks the signature and timestamp of the body, returning the
+// signature.
+func (in webhookIntegration) verify(h http.Header, body []byte, now time.Time) ([]byte, error) {
+	var header, tsHeader, prefix, signed string
+	switch in.Scheme {
+	case schemeSlack:
+		header, tsHeader, prefix = "X-Slack-Signature", "X-Slack-Request-Timestamp", "v0="
+	default:
+		header, tsHeader, prefix = in.Header, in.TimestampHeader, "sha256="
+		if header == "" {
+			header = "X-Signature"
+		}
+		if tsHeader == "" {
+			tsHeader = "X-Timestamp"
+		}
+	}
+	ts := h.Get(tsHeader)
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return nil, errors.New("missing or invalid timestamp")
+	}
+	if d := now.Sub(time.Unix(unix, 0)); d > in.tolerance || d < -in.tolerance {
+		return nil, errors.New("timestamp out of tolerance")
+	}
+	if in.Scheme == schemeSlack {
+		signed = "v0:" + ts + ":"
+	} else {
+		signed = ts + "."
+	}
+	sig, err := hex.DecodeString(strings.TrimPrefix(h.Get(header), prefix))
+	if err != nil {
+		return nil, errors.New("invalid signature")
+	}
+	mac := hmac.New(sha256.New, []byte(in.Secret))
+	mac.Write([]byte(signed))
+	mac.Write(body)
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return nil, errors.New("invalid signature")
+	}
+	return sig, nil
+}
+
+// decode reads the message fields from a JSON or form body.
+func (in webhookIntegration) decode(contentType string, body []byte) (message, error) {
+	var doc any
+	if mediaType, _, _ := mime.ParseMediaType(contentType); mediaType == "application/x-www-form-urlencoded" {
+		form, err := url.ParseQuery(string(body))
+		if err != nil {
+			return message{}, fmt.Errorf("invalid form: %w", err)
+		}
+		fields := make(map[string]any)
+		for field := range form {
+			fields[field] = form.Get(field)
+		}
+		doc = fields
+	} else {
+		dec := json.NewDecoder(bytes.NewReader(body))
+		dec.UseNumber()
+		if err := dec.Decode(&doc); err != nil {
+			return message{}, fmt.Errorf("invalid JSON: %w", err)
+		}
+	}
+	fields := make(map[string]string)
+	for _, field := range webhookFields {
+		path, ok := in.Mapping[field]
+		if !ok {
+			path = "$." + field
+		}
+		steps, _ := parseJSONPath(path)
+		if v, ok := lookupJSONPath(doc, steps); ok {
+			fields[field] = v
+		}
+	}
+	if fields["text"] == "" {
+		return message{}, errors.New("message has no text")
+	}
+	return message{
+		Text:      fields["text"],
+		AuthorID:  fields["author"],
+		MessageID: fields["id"],
+		Source:    fields["source"],
+		When:      time.Now(),
+	}, nil
+}
+
+// parseJSONPath parses the subset of JSONPath naming a single value:
+// $.field, $['field'] and $.list[0], in any combination.
+func parseJSONPath(path string) ([]string, error) {
+	rest, ok := strings.CutPrefix(path, "$")
+	if !ok {
+		return nil, fmt.Errorf("JSONPath %q must start with $", path)
+	}
+	var steps []string
+	for rest != "" {
+		switch rest[0] {
+		case '.':
+			rest = rest[1:]
+			end := strings.IndexAny(rest, ".[")
+			if end < 0 {
+				end = len(rest)
+			}
+			if end == 0 {
+				return nil, fmt.Errorf("JSONPath %q has an empty field", path)
+			}
+			steps = append(steps, rest[:end])
+			rest = rest[end:]
+		case '[':
+			end := strings.IndexByte(rest, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("JSONPath %q has an unclosed [", path)
+			}
+			step := rest[1:end]
+			if unquoted, ok := strings.CutPrefix(step, "'"); ok {
+				step, ok = strings.CutSuffix(unquoted, "'")
+				if !ok {
+					return nil, fmt.Errorf("JSONPath %q has an unclosed quote", path)
+				}
+			} else if _, err := strconv.Atoi(step); err != nil {
+				return nil, fmt.Errorf("JSONPath %q has an invalid index %q", path, step)
+			}
+			steps = append(steps, step)
+			rest = rest[end+1:]
+		default:
+			return nil, fmt.Errorf("JSONPath %q is not supported", path)
+		}
+	}
+	return steps, nil
+}
+
+// lookupJSONPath returns the value at the steps of a parsed JSONPath as a
+// string, if it is a string, number or boolean.
+func lookupJSONPath(v any, steps []string) (string, bool) {
+	for _, step := range steps {
+		switch node := v.(type) {
+		case map[string]any:
+			v = node[step]
+		case []any:
+			i, err := strconv.Atoi(step)
+			if err != nil || i < 0 || i >= len(node) {
+				return "", false
+			}
+			v = node[i]
+		default:
+			return "", false
+		}
+	}
+	switch v := v.(type) {
+	case string:
+		return v, true
+	case json.Number:
+		return v.String(), true
+	case bool:
+		return strconv.FormatBool(v), true
+	}
+	return "", false
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func sign(secret, signed string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(signed))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestWebhookVerify(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	ts := strconv.FormatInt(now.Unix(), 10)
+	stale := strconv.FormatInt(now.Add(-10*time.Minute).Unix(), 10)
+	body := "text=%23mypoll+one&user_id=U123"
+	hmacIn := webhookIntegration{Secret: "s3cret", Scheme: schemeHMAC, tolerance: webhookTolerance}
+	slackIn := webhookIntegration{Secret: "s3cret", Scheme: schemeSlack, tolerance: webhookTolerance}
+	tests := []struct {
+		name    string
+		in      webhookIntegration
+		headers map[string]string
+		ok      bool
+	}{
+		{"hmac", hmacIn, map[string]string{"X-Timestamp": ts, "X-Signature": "sha256=" + sign("s3cret", ts+"."+body)}, true},
+		{"hmac without prefix", hmacIn, map[string]string{"X-Timestamp": ts, "X-Signature": sign("s3cret", ts+"."+body)}, true},
+		{"hmac without timestamp", hmacIn, map[string]string{"X-Signature": sign("s3cret", body)}, false},
+		{"hmac stale", hmacIn, map[string]string{"X-Timestamp": stale, "X-Signature": sign("s3cret", stale+"."+body)}, false},
+		{"hmac wrong secret", hmacIn, map[string]string{"X-Timestamp": ts, "X-Signature": sign("other", ts+"."+body)}, false},
+		{"slack", slackIn, map[string]string{"X-Slack-Request-Timestamp": ts, "X-Slack-Signature": "v0=" + sign("s3cret", "v0:"+ts+":"+body)}, true},
+		{"slack stale", slackIn, map[string]string{"X-Slack-Request-Timestamp": stale, "X-Slack-Signature": "v0=" + sign("s3cret", "v0:"+stale+":"+body)}, false},
+		{"slack signed as hmac", slackIn, map[string]string{"X-Slack-Request-Timestamp": ts, "X-Slack-Signature": "v0=" + sign("s3cret", ts+"."+body)}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := http.Header{}
+			for k, v := range tt.headers {
+				h.Set(k, v)
+			}
+			_, err := tt.in.verify(h, []byte(body), now)
+			if (err == nil) != tt.ok {
+				t.Errorf("verify() = %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestWebhookReplay(t *testing.T) {
+	s := &webhookSource{seen: make(map[string]time.Time)}
+	now := time.Now()
+	if !s.firstSeen("slack:ab", now.Add(time.Minute), now) {
+		t.Fatal("first message rejected")
+	}
+	if s.firstSeen("slack:ab", now.Add(time.Minute), now.Add(30*time.Second)) {
+		t.Error("replay accepted")
+	}
+	if !s.firstSeen("slack:ab", now.Add(3*time.Minute), now.Add(2*time.Minute)) {
+		t.Error("signature kept after it expired")
+	}
+}
+
+func TestWebhookDecodeSlackCommand(t *testing.T) {
+	in := webhookIntegration{Scheme: schemeSlack, Mapping: slackMapping}
+	msg, err := in.decode("application/x-www-form-urlencoded", []byte("command=%2Fvote&text=%23mypoll+one&user_id=U123&trigger_id=T9"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Text != "#mypoll one" || msg.AuthorID != "U123" || msg.MessageID != "T9" {
+		t.Errorf("decoded %+v", msg)
+	}
+}
@@ -0,0 +1,89 @@
+package count
+
+import (
+	"context"
+	"slices"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// poll types
+const (
+	typePlurality = "plurality" // one option per vote
+	typeApproval  = "approval"  // any number of options per vote
+	typeRanked    = "ranked"    // options in order of preference, instant-runoff
+	typeWeighted  = "weighted"  // one option per vote, counted by weight
+)
+
+// pollInfo is what the counter needs to know about an open poll.
+type pollInfo struct {
+	Type    string
+	Options []string
+	Policy  votePolicy
+}
+
+// storedBallot is a ranked-choice ballot, kept so the api can run the
+// instant-runoff rounds.
+type storedBallot struct {
+	PollID  string    `bson:"poll_id"`
+	Voter   string    `bson:"voter,omitempty"`
+	Ranking []string  `bson:"ranking"`
+	Weight  int       `bson:"weight"`
+	CastAt  time.Time `bson:"cast_at"`
+}
+
+// normalize returns the options of the ballot that belong to the poll,
+// without duplicates and in their original order, or nil if the ballot
+// is not valid for the poll type.
+func (info pollInfo) normalize(ballot []string) []string {
+	var valid []string
+	for _, option := range ballot {
+		if slices.Contains(info.Options, option) && !slices.Contains(valid, option) {
+			valid = append(valid, option)
+		}
+	}
+	switch info.Type {
+	case typeApproval, typeRanked:
+	default:
+		if len(valid) != 1 {
+			return nil
+		}
+	}
+	return valid
+}
+
+// deltas returns the changes to the counts of a ballot. Approval ballots
+// count for every option, and ranked-choice ballots count for their
+// first preference, the first round of the instant-runoff.
+func (info pollInfo) deltas(pollID string, ballot []string, weight int) []delta {
+	if len(ballot) == 0 {
+		return nil
+	}
+	if info.Type != typeWeighted {
+		weight = 1
+	}
+	if info.Type != typeApproval {
+		ballot = ballot[:1]
+	}
+	var ds []delta
+	for _, option := range ballot {
+		ds = append(ds, delta{voteKey{PollID: pollID, Option: option}, weight})
+	}
+	return ds
+}
+
+// storeBallot records a ranked-choice ballot. A voter only ever has one
+// ballot, which is replaced when the vote is changed.
+func (db *store) storeBallot(ctx context.Context, b storedBallot) error {
+	if b.Voter == "" {
+		_, err := db.ballots.InsertOne(ctx, b)
+		return err
+	}
+	_, err := db.ballots.ReplaceOne(ctx,
+		bson.M{"poll_id": b.PollID, "voter": b.Voter}, b,
+		options.Replace().SetUpsert(true),
+	)
+	return err
+}
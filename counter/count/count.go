@@ -0,0 +1,363 @@
+// Package count counts the votes consumed from the "votes" topic into the
+// results of their polls.
+package count
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/liyu-wang/go-socialpoll/broker"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const updateDuration = 1 * time.Second
+
+// DefaultPolicy is the voting policy of polls without one, unless another
+// is given to Run.
+const DefaultPolicy = policySingle
+
+// ValidatePolicy checks the name of a voting policy.
+func ValidatePolicy(mode string) error {
+	return votePolicy{Mode: mode}.validate()
+}
+
+// Run consumes votes from the "votes" topic as the "counter" group and
+// flushes their counts to the polls every second until ctx is done.
+// Polls without a voting policy follow defaultPolicy.
+func Run(ctx context.Context, client *mongo.Client, votes broker.Consumer, defaultPolicy string) error {
+	if err := ValidatePolicy(defaultPolicy); err != nil {
+		return err
+	}
+	db := &store{
+		polls:         client.Database("ballots").Collection("polls"),
+		votes:         client.Database("ballots").Collection("votes"),
+		voters:        client.Database("ballots").Collection("voters"),
+		ballots:       client.Database("ballots").Collection("ballots"),
+		defaultPolicy: votePolicy{Mode: defaultPolicy},
+	}
+
+	indexCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	err := db.ensureIndexes(indexCtx)
+	cancel()
+	if err != nil {
+		return fmt.Errorf("failed to create indexes: %w", err)
+	}
+
+	t := &tally{}
+	consumeCtx, stopConsuming := context.WithCancel(ctx)
+	defer stopConsuming()
+	consumed := make(chan error, 1)
+	go func() {
+		consumed <- votes.Consume(consumeCtx, "votes", "counter", func(body []byte) error {
+			v, err := broker.DecodeVote(body)
+			if err != nil {
+				// redelivering a malformed message would only fail again
+				log.Println("Dropping vote:", err)
+				return nil
+			}
+			t.Lock()
+			t.received = append(t.received, v)
+			t.Unlock()
+			log.Printf("Vote received: %s (poll: %q, source: %q, author: %q)\n", v.Option, v.PollID, v.Source, v.AuthorID)
+			return nil
+		})
+	}()
+
+	// Periodic timer to update database with vote counts
+	ticker := time.NewTicker(updateDuration)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			doCount(ctx, t, db)
+		case err := <-consumed:
+			if err == nil {
+				// stopped by ctx, so flush what was received with
+				// a context of its own
+				flushCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+				doCount(flushCtx, t, db)
+				cancel()
+				return nil
+			}
+			return fmt.Errorf("failed to consume votes: %w", err)
+		}
+	}
+}
+
+// OpenPollsFilter selects the polls accepting votes at the given time.
+// Polls created before statuses existed have no status and count as open.
+func OpenPollsFilter(now time.Time) bson.M {
+	return bson.M{
+		"status":    bson.M{"$nin": []string{"draft", "closed", "archived"}},
+		"opens_at":  bson.M{"$not": bson.M{"$gt": now}},
+		"closes_at": bson.M{"$not": bson.M{"$lte": now}},
+	}
+}
+
+// voteKey identifies the option of a single poll that votes are counted for.
+// Legacy votes have no PollID.
+type voteKey struct {
+	PollID string
+	Option string
+}
+
+// store is where the counter keeps polls and votes.
+type store struct {
+	polls   *mongo.Collection
+	votes   *mongo.Collection
+	voters  *mongo.Collection
+	ballots *mongo.Collection
+
+	// defaultPolicy applies to polls without a voting policy
+	defaultPolicy votePolicy
+}
+
+func (db *store) ensureIndexes(ctx context.Context) error {
+	// index recorded votes for listing the latest votes of a poll
+	_, err := db.votes.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "poll_id", Value: 1}, {Key: "timestamp", Value: -1}},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = db.voters.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "poll_id", Value: 1}, {Key: "voter", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = db.ballots.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "poll_id", Value: 1}, {Key: "voter", Value: 1}},
+	})
+	return err
+}
+
+// tally holds the votes received since the last flush.
+type tally struct {
+	sync.Mutex
+	// received votes waiting for their voting policy to be applied
+	received []vote
+	// counts waiting to be written to the polls
+	counts map[voteKey]int
+	// accepted votes waiting to be recorded
+	pending []appliedVote
+	// ballots of ranked-choice polls waiting to be stored
+	ballots []storedBallot
+}
+
+// applyPolicies moves the received votes into the counts according to
+// the voting policy of their polls. Votes that fail to be checked stay
+// received for the next flush.
+func applyPolicies(ctx context.Context, t *tally, db *store, now time.Time) {
+	if len(t.received) == 0 {
+		return
+	}
+	if t.counts == nil {
+		t.counts = make(map[voteKey]int)
+	}
+	var ids []string
+	for _, v := range t.received {
+		if v.PollID != "" {
+			ids = append(ids, v.PollID)
+		}
+	}
+	opCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	polls, err := db.loadPolls(opCtx, ids, now)
+	if err != nil {
+		log.Println("Error loading polls:", err)
+		return
+	}
+	var retry []vote
+	for _, v := range t.received {
+		if v.PollID == "" {
+			// legacy votes carry no poll, and so no policy
+			t.counts[voteKey{Option: v.Option}]++
+			continue
+		}
+		info, ok := polls[v.PollID]
+		if !ok {
+			log.Printf("Dropping vote for '%s': poll %s not found or closed", v.Option, v.PollID)
+			continue
+		}
+		deltas, ballot, err := db.applyPolicy(opCtx, info, v)
+		if err != nil {
+			log.Printf("Error applying voting policy to poll %s: %v", v.PollID, err)
+			retry = append(retry, v)
+			continue
+		}
+		if len(deltas) == 0 {
+			log.Printf("Dropping vote for '%s' in poll %s: invalid ballot, or %s:%s already voted (policy %s)", v.Option, v.PollID, v.Source, v.AuthorID, info.Policy.Mode)
+			continue
+		}
+		for _, d := range deltas {
+			t.counts[d.key] += d.n
+		}
+		applied := appliedVote{vote: v}
+		for _, d := range deltas {
+			applied.keys = append(applied.keys, d.key)
+		}
+		t.pending = append(t.pending, applied)
+		if ballot != nil {
+			t.ballots = append(t.ballots, *ballot)
+		}
+	}
+	t.received = retry
+}
+
+// storeBallots stores the waiting ballots in the order they were cast,
+// keeping those that fail to store for the next flush.
+func storeBallots(ctx context.Context, t *tally, db *store) {
+	opCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	for i, b := range t.ballots {
+		if err := db.storeBallot(opCtx, b); err != nil {
+			log.Printf("Error storing %d ballots: %v", len(t.ballots)-i, err)
+			t.ballots = t.ballots[i:]
+			return
+		}
+	}
+	t.ballots = nil
+}
+
+// doCount applies voting policies to the received votes, flushes the vote
+// counts to the polls and records the counted votes. Counts that fail to
+// update are kept, with their votes, for the next flush.
+func doCount(ctx context.Context, t *tally, db *store) {
+	t.Lock()
+	defer t.Unlock()
+
+	// votes are checked against the poll window when they are flushed,
+	// so results freeze at closing time give or take updateDuration
+	now := time.Now()
+	applyPolicies(ctx, t, db, now)
+	storeBallots(ctx, t, db)
+	counts := &t.counts
+
+	if len(*counts) == 0 {
+		log.Println("No new votes, skipping database update")
+		return
+	}
+
+	log.Println("Updating database...")
+	log.Println("Current counts:", *counts)
+
+	ok := true
+	counted := make(map[voteKey]bool)
+	for key, count := range *counts {
+		if count == 0 {
+			// changed votes that cancel out
+			counted[key] = true
+			delete(*counts, key)
+			continue
+		}
+		// Create a dedicated timeout context for this operation
+		opCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		// update to increment the vote count
+		up := bson.M{"$inc": bson.M{"results." + key.Option: count}}
+		if key.PollID == "" {
+			// legacy votes carry no poll, so count them for every poll with the option
+			sel := OpenPollsFilter(now)
+			sel["options"] = bson.M{"$in": []string{key.Option}}
+			log.Printf("Searching with filter: %v", sel)
+			result, err := db.polls.UpdateMany(opCtx, sel, up)
+			if err != nil {
+				log.Printf("Error updating vote count for %s: %v", key.Option, err)
+				ok = false
+			} else {
+				log.Printf("Updated %d documents for option '%s' with count %d", result.ModifiedCount, key.Option, count)
+				delete(*counts, key)
+			}
+			cancel()
+			continue
+		}
+		pollID, err := primitive.ObjectIDFromHex(key.PollID)
+		if err != nil {
+			log.Printf("Dropping %d votes for invalid poll ID %q", count, key.PollID)
+			delete(*counts, key)
+			cancel()
+			continue
+		}
+		// filter to find the poll by ID, only if it has the option and is open
+		sel := OpenPollsFilter(now)
+		sel["_id"] = pollID
+		sel["options"] = key.Option
+		result, err := db.polls.UpdateOne(opCtx, sel, up)
+		if err != nil {
+			log.Printf("Error updating vote count for %s in poll %s: %v", key.Option, key.PollID, err)
+			ok = false
+		} else if result.MatchedCount == 0 {
+			log.Printf("Dropping %d votes for '%s': poll %s not found, closed or has no such option", count, key.Option, key.PollID)
+			delete(*counts, key)
+		} else {
+			log.Printf("Updated poll %s option '%s' with count %d", key.PollID, key.Option, count)
+			counted[key] = true
+			delete(*counts, key)
+		}
+		cancel()
+	}
+	recordVotes(ctx, counted, *counts, &t.pending, db.votes)
+	if ok {
+		log.Println("Finished updating database...")
+	}
+}
+
+// appliedVote is a vote accepted by its poll's voting policy, with the
+// counts it changed, which for a changed vote include the counts of the
+// vote it replaced.
+type appliedVote struct {
+	vote vote
+	keys []voteKey
+}
+
+// settleVotes sorts the pending votes into those to record, once all of
+// their counts were flushed and at least one was counted, and those whose
+// counts are still waiting, whichever way they go. Votes none of whose
+// counts were counted were rejected and are dropped.
+func settleVotes(counted map[voteKey]bool, waiting map[voteKey]int, pending []appliedVote) (record []vote, keep []appliedVote) {
+	for _, v := range pending {
+		var isWaiting, isCounted bool
+		for _, key := range v.keys {
+			if _, ok := waiting[key]; ok {
+				isWaiting = true
+			}
+			if counted[key] {
+				isCounted = true
+			}
+		}
+		switch {
+		case isWaiting:
+			keep = append(keep, v)
+		case isCounted:
+			record = append(record, v.vote)
+		}
+	}
+	return record, keep
+}
+
+// recordVotes stores the pending votes that were counted, see
+// settleVotes.
+func recordVotes(ctx context.Context, counted map[voteKey]bool, waiting map[voteKey]int, pending *[]appliedVote, voteData *mongo.Collection) {
+	record, keep := settleVotes(counted, waiting, *pending)
+	*pending = keep
+	if len(record) == 0 {
+		return
+	}
+	docs := make([]any, len(record))
+	for i, v := range record {
+		docs[i] = v
+	}
+	opCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	if _, err := voteData.InsertMany(opCtx, docs); err != nil {
+		// the votes are already counted, so only their audit trail is lost
+		log.Printf("Error recording %d votes: %v", len(docs), err)
+	}
+}
@@ -0,0 +1,34 @@
+package count
+
+import "testing"
+
+func TestSettleVotesChangePolicy(t *testing.T) {
+	a := voteKey{PollID: "p", Option: "a"}
+	b := voteKey{PollID: "p", Option: "b"}
+	// an earlier flush counted a vote for a, and this one holds the voter
+	// changing to b and back to a, and another voter changing from a to b
+	back := appliedVote{vote: vote{Option: "a", AuthorID: "alice"}, keys: []voteKey{a, b}}
+	toB := appliedVote{vote: vote{Option: "b", AuthorID: "alice"}, keys: []voteKey{b, a}}
+	other := appliedVote{vote: vote{Option: "b", AuthorID: "bob"}, keys: []voteKey{b, a}}
+	pending := []appliedVote{toB, back, other}
+
+	tests := []struct {
+		name    string
+		counted map[voteKey]bool
+		waiting map[voteKey]int
+		record  int
+		keep    int
+	}{
+		{"all counted", map[voteKey]bool{a: true, b: true}, nil, 3, 0},
+		{"negative count waiting", map[voteKey]bool{b: true}, map[voteKey]int{a: -1}, 0, 3},
+		{"all rejected", nil, nil, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			record, keep := settleVotes(tt.counted, tt.waiting, pending)
+			if len(record) != tt.record || len(keep) != tt.keep {
+				t.Errorf("recorded %d and kept %d votes, want %d and %d", len(record), len(keep), tt.record, tt.keep)
+			}
+		})
+	}
+}
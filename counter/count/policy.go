@@ -0,0 +1,203 @@
+package count
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// voting policies
+const (
+	policyUnlimited = "unlimited" // every vote counts
+	policySingle    = "single"    // first vote counts, later ones are dropped
+	policyChange    = "change"    // last vote counts, replacing the previous one
+	policyWindow    = "window"    // up to Limit votes per Window
+)
+
+// votePolicy limits how often a voter can vote in a poll. Voters are
+// identified by the source and author of their votes.
+type votePolicy struct {
+	Mode   string `bson:"mode"`
+	Limit  int    `bson:"limit,omitempty"`
+	Window string `bson:"window,omitempty"` // time.ParseDuration format
+}
+
+func (p votePolicy) validate() error {
+	switch p.Mode {
+	case policyUnlimited, policySingle, policyChange:
+		return nil
+	case policyWindow:
+		d, err := time.ParseDuration(p.Window)
+		if err != nil || d <= 0 || p.Limit < 1 {
+			return fmt.Errorf("window policy needs a positive limit and window")
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown voting policy %q", p.Mode)
+}
+
+// voter is what is known about a voter's votes in a poll.
+type voter struct {
+	PollID string      `bson:"poll_id"`
+	Voter  string      `bson:"voter"`
+	Ballot []string    `bson:"ballot"`
+	Option string      `bson:"option,omitempty"` // before ballots
+	Weight int         `bson:"weight,omitempty"`
+	Times  []time.Time `bson:"times,omitempty"`
+}
+
+func (v voter) ballot() []string {
+	if len(v.Ballot) == 0 && v.Option != "" {
+		return []string{v.Option}
+	}
+	return v.Ballot
+}
+
+func (v voter) weight() int {
+	return max(v.Weight, 1)
+}
+
+// delta is a change to the count of an option.
+type delta struct {
+	key voteKey
+	n   int
+}
+
+// loadPolls returns the type, options and voting policy of each open
+// poll among ids. Polls that are missing or not open are left out.
+func (db *store) loadPolls(ctx context.Context, ids []string, now time.Time) (map[string]pollInfo, error) {
+	var objIDs []primitive.ObjectID
+	for _, id := range ids {
+		if objID, err := primitive.ObjectIDFromHex(id); err == nil {
+			objIDs = append(objIDs, objID)
+		}
+	}
+	sel := OpenPollsFilter(now)
+	sel["_id"] = bson.M{"$in": objIDs}
+	opts := options.Find().SetProjection(bson.M{"type": 1, "options": 1, "vote_policy": 1})
+	cursor, err := db.polls.Find(ctx, sel, opts)
+	if err != nil {
+		return nil, err
+	}
+	var polls []struct {
+		ID      primitive.ObjectID `bson:"_id"`
+		Type    string             `bson:"type"`
+		Options []string           `bson:"options"`
+		Policy  *votePolicy        `bson:"vote_policy"`
+	}
+	if err := cursor.All(ctx, &polls); err != nil {
+		return nil, err
+	}
+	infos := make(map[string]pollInfo)
+	for _, p := range polls {
+		info := pollInfo{Type: p.Type, Options: p.Options, Policy: db.defaultPolicy}
+		if info.Type == "" {
+			info.Type = typePlurality
+		}
+		if p.Policy != nil && p.Policy.validate() == nil {
+			info.Policy = *p.Policy
+		}
+		infos[p.ID.Hex()] = info
+	}
+	return infos, nil
+}
+
+// applyPolicy checks the vote against the poll's voting policy, recording
+// it for its voter, and returns the resulting changes to the counts and,
+// for ranked-choice polls, the ballot to store. A vote the policy rejects,
+// or that is not valid for the poll, results in no changes. The ballot is
+// left to the caller to store, so that failing to store it cannot make the
+// vote go through the policy twice.
+func (db *store) applyPolicy(ctx context.Context, info pollInfo, v vote) ([]delta, *storedBallot, error) {
+	ballot := info.normalize(v.Ballot())
+	if ballot == nil {
+		return nil, nil, nil
+	}
+	deltas := info.deltas(v.PollID, ballot, v.CountedWeight())
+	var name string
+	if v.AuthorID != "" {
+		name = v.Source + ":" + v.AuthorID
+	}
+	b := storedBallot{PollID: v.PollID, Voter: name, Ranking: ballot, Weight: v.CountedWeight(), CastAt: v.Timestamp}
+	policy := info.Policy
+	if policy.Mode == policyUnlimited || name == "" {
+		// anonymous votes cannot be limited
+		b.Voter = ""
+		return deltas, ranked(info, b), nil
+	}
+	id := bson.M{"poll_id": v.PollID, "voter": name}
+	switch policy.Mode {
+	case policySingle:
+		_, err := db.voters.InsertOne(ctx, voter{PollID: v.PollID, Voter: name, Ballot: ballot, Weight: v.CountedWeight()})
+		if mongo.IsDuplicateKeyError(err) {
+			return nil, nil, nil
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		return deltas, ranked(info, b), nil
+
+	case policyChange:
+		var before voter
+		err := db.voters.FindOneAndUpdate(ctx, id,
+			bson.M{"$set": bson.M{"ballot": ballot, "weight": v.CountedWeight()}},
+			options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.Before),
+		).Decode(&before)
+		if err == mongo.ErrNoDocuments {
+			return deltas, ranked(info, b), nil
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if slices.Equal(before.ballot(), ballot) && before.weight() == v.CountedWeight() {
+			return nil, nil, nil
+		}
+		// undo the previous vote
+		for _, d := range info.deltas(v.PollID, before.ballot(), before.weight()) {
+			deltas = append(deltas, delta{d.key, -d.n})
+		}
+		return deltas, ranked(info, b), nil
+
+	case policyWindow:
+		window, _ := time.ParseDuration(policy.Window)
+		var existing voter
+		err := db.voters.FindOne(ctx, id).Decode(&existing)
+		if err != nil && err != mongo.ErrNoDocuments {
+			return nil, nil, err
+		}
+		times := []time.Time{v.Timestamp}
+		for _, t := range existing.Times {
+			if v.Timestamp.Sub(t) < window {
+				times = append(times, t)
+			}
+		}
+		if len(times) > policy.Limit {
+			return nil, nil, nil
+		}
+		_, err = db.voters.UpdateOne(ctx, id,
+			bson.M{"$set": bson.M{"ballot": ballot, "weight": v.CountedWeight(), "times": times}},
+			options.Update().SetUpsert(true),
+		)
+		if err != nil {
+			return nil, nil, err
+		}
+		// every vote in the window is a ballot of its own
+		b.Voter = ""
+		return deltas, ranked(info, b), nil
+	}
+	return nil, nil, fmt.Errorf("unknown voting policy %q", policy.Mode)
+}
+
+// ranked returns the ballot if the poll is ranked-choice, and nil otherwise.
+func ranked(info pollInfo, b storedBallot) *storedBallot {
+	if info.Type != typeRanked {
+		return nil
+	}
+	return &b
+}
@@ -0,0 +1,6 @@
+package count
+
+import "github.com/liyu-wang/go-socialpoll/broker"
+
+// vote is the envelope published to the "votes" topic, see broker.Vote.
+type vote = broker.Vote
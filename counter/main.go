@@ -7,12 +7,11 @@ import (
 	"log"
 	"os"
 	"os/signal"
-	"sync"
 	"syscall"
 	"time"
 
-	"github.com/nsqio/go-nsq"
-	"go.mongodb.org/mongo-driver/bson"
+	"github.com/liyu-wang/go-socialpoll/broker"
+	"github.com/liyu-wang/go-socialpoll/counter/count"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
@@ -25,8 +24,6 @@ func fatal(e error) {
 	fatalErr = e
 }
 
-const updateDuration = 1 * time.Second
-
 func main() {
 	defer func() {
 		if fatalErr != nil {
@@ -34,6 +31,14 @@ func main() {
 		}
 	}()
 
+	defaultPolicy := flag.String("policy", count.DefaultPolicy, "voting policy for polls without one: unlimited, single or change")
+	brokerConfig := broker.Flags(flag.CommandLine)
+	flag.Parse()
+	if err := count.ValidatePolicy(*defaultPolicy); err != nil {
+		fatal(err)
+		return
+	}
+
 	log.Println("Connecting to database...")
 
 	// Connection context with timeout for initial connection only
@@ -67,93 +72,17 @@ func main() {
 	}
 	log.Println("Successfully connected to mongodb")
 
-	// Create a separate, non-expiring context for all database operations
-	operationCtx, operationCancel := context.WithCancel(context.Background())
-	defer operationCancel()
-
-	pollData := client.Database("ballots").Collection("polls")
-
-	var counts map[string]int
-	var countsLock sync.Mutex
-
-	log.Println("Connecting to nsq...")
-	q, err := nsq.NewConsumer("votes", "counter", nsq.NewConfig())
+	log.Printf("Connecting to %s...", brokerConfig.Kind)
+	votes, err := broker.NewConsumer(*brokerConfig)
 	if err != nil {
-		fatal(fmt.Errorf("failed to create nsq consumer: %w", err))
-		return
-	}
-
-	q.AddHandler(nsq.HandlerFunc(func(message *nsq.Message) error {
-		countsLock.Lock()
-		defer countsLock.Unlock()
-		if counts == nil {
-			counts = make(map[string]int)
-		}
-		vote := string(message.Body)
-		counts[vote]++
-		log.Printf("Vote received: %s, total: %d\n", vote, counts[vote])
-		return nil
-	}))
-
-	// Connect to nsqlookupd
-	if err := q.ConnectToNSQLookupd("localhost:4161"); err != nil {
-		fatal(fmt.Errorf("failed to connect to nsq: %w", err))
-		return
-	}
-
-	// Periodic timer to update database with vote counts
-	ticker := time.NewTicker(updateDuration)
-	termchan := make(chan os.Signal, 1)
-	signal.Notify(termchan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
-
-	// Keep the application running
-	for {
-		select {
-		case <-ticker.C:
-			doCount(operationCtx, &countsLock, &counts, pollData)
-		case <-termchan:
-			ticker.Stop()
-			q.Stop()
-		case <-q.StopChan:
-			//finished
-			return
-		}
-	}
-}
-
-func doCount(ctx context.Context, countsLock *sync.Mutex, counts *map[string]int, pollData *mongo.Collection) {
-	countsLock.Lock()
-	defer countsLock.Unlock()
-
-	if len(*counts) == 0 {
-		log.Println("No new votes, skipping database update")
+		fatal(fmt.Errorf("failed to connect to %s: %w", brokerConfig.Kind, err))
 		return
 	}
 
-	log.Println("Updating database...")
-	log.Println("Current counts:", *counts)
-
-	ok := true
-	for option, count := range *counts {
-		// Create a dedicated timeout context for this operation
-		opCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
-		// filter to find the poll option
-		sel := bson.M{"options": bson.M{"$in": []string{option}}}
-		log.Printf("Searching with filter: %v", sel)
-
-		// update to increment the vote count
-		up := bson.M{"$inc": bson.M{"results." + option: count}}
-		result, err := pollData.UpdateMany(opCtx, sel, up)
-		if err != nil {
-			log.Printf("Error updating vote count for %s: %v", option, err)
-			ok = false
-		} else {
-			log.Printf("Updated %d documents for option '%s' with count %d", result.ModifiedCount, option, count)
-		}
-		cancel()
-	}
-	if ok {
-		log.Println("Finished updating database...")
-		*counts = nil // reset counts after successful update
+	// stop on an interrupt signal such as control+C
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	defer stop()
+	if err := count.Run(ctx, client, votes, *defaultPolicy); err != nil {
+		fatal(err)
 	}
 }
@@ -181,7 +181,7 @@ echo -e "\n${BLUE}Services running:${NC}"
 echo "  • nsqlookupd (port 4160, 4161)"
 echo "  • nsqd (port 4150)"
 echo "  • MongoDB (port 27017)"
-echo "  • chatvotes (WebSocket at localhost:8080/room)"
+echo "  • chatvotes (chat rooms at localhost:8081, see -chat-url)"
 echo "  • counter (consuming votes from NSQ)"
 echo ""
 echo -e "${BLUE}To stop services:${NC}"